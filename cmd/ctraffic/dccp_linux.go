@@ -0,0 +1,327 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+//go:build linux
+
+// DCCP (RFC 4340) is not supported by the Go "net" package. Sockets
+// are created with syscall and wrapped in an os.File. The fd is
+// non-blocking so the os.File is handled by the runtime poller and
+// deadlines work as for a net.Conn.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	solDccp            = 269
+	dccpSockoptService = 2
+	// The service code must be the same in client and server ("ctrf")
+	dccpService = 0x63747266
+)
+
+func dccpSockaddr(a *net.TCPAddr) (syscall.Sockaddr, int) {
+	if ip := a.IP.To4(); ip != nil {
+		sa := &syscall.SockaddrInet4{Port: a.Port}
+		copy(sa.Addr[:], ip)
+		return sa, syscall.AF_INET
+	}
+	sa := &syscall.SockaddrInet6{Port: a.Port}
+	copy(sa.Addr[:], a.IP.To16())
+	return sa, syscall.AF_INET6
+}
+
+func sockaddrString(sa syscall.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	case *syscall.SockaddrInet6:
+		return net.JoinHostPort(net.IP(sa.Addr[:]).String(), strconv.Itoa(sa.Port))
+	}
+	return ""
+}
+
+// dccpSocket returns a non-blocking DCCP socket with the service code set
+func dccpSocket(family int) (*os.File, error) {
+	fd, err := syscall.Socket(
+		family, syscall.SOCK_DCCP|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC,
+		syscall.IPPROTO_DCCP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	var service [4]byte
+	binary.BigEndian.PutUint32(service[:], dccpService)
+	err = syscall.SetsockoptString(fd, solDccp, dccpSockoptService, string(service[:]))
+	if err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	return os.NewFile(uintptr(fd), "dccp"), nil
+}
+
+// dccpDial connects a DCCP socket. The connect is non-blocking so the
+// timeout and the context are respected.
+func dccpDial(
+	ctx context.Context, laddr net.Addr, address string,
+	timeout time.Duration) (*os.File, error) {
+
+	raddr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	sa, family := dccpSockaddr(raddr)
+	f, err := dccpSocket(family)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if a, ok := laddr.(*net.TCPAddr); ok && a != nil {
+			lsa, _ := dccpSockaddr(a)
+			if serr = syscall.Bind(int(fd), lsa); serr != nil {
+				serr = os.NewSyscallError("bind", serr)
+				return
+			}
+		}
+		serr = syscall.Connect(int(fd), sa)
+		if serr == syscall.EINPROGRESS {
+			serr = nil
+		} else if serr != nil {
+			serr = os.NewSyscallError("connect", serr)
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Wait until the socket is writable, then check the result
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := f.SetWriteDeadline(deadline); err != nil {
+		f.Close()
+		return nil, err
+	}
+	waited := false
+	err = rc.Write(func(fd uintptr) bool {
+		if !waited {
+			waited = true
+			return false
+		}
+		n, err := syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err != nil {
+			serr = os.NewSyscallError("getsockopt", err)
+		} else if n != 0 {
+			serr = os.NewSyscallError("connect", syscall.Errno(n))
+		}
+		return true
+	})
+	if err == nil {
+		err = serr
+	}
+	if err == nil {
+		err = f.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// ----------------------------------------------------------------------
+// DCCP client
+
+type dccpConn struct {
+	cd   *connData
+	conn *os.File
+}
+
+func newDccpConn(cd *connData) ctConn {
+	return &dccpConn{
+		cd: cd,
+	}
+}
+
+func (c *dccpConn) Connect(ctx context.Context, address string) error {
+	var err error
+	c.conn, err = dccpDial(ctx, c.cd.localAddr, address, c.cd.connectTimeout)
+	return err
+}
+
+// Run sends packets and reads the echoes. DCCP is unreliable so lost
+// packets are counted as for UDP, i.e. not received.
+func (c *dccpConn) Run(ctx context.Context, s *statistics) error {
+	defer c.conn.Close()
+
+	if rc, err := c.conn.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			if sa, err := syscall.Getsockname(int(fd)); err == nil {
+				c.cd.local = sockaddrString(sa)
+			}
+			if sa, err := syscall.Getpeername(int(fd)); err == nil {
+				c.cd.remote = sockaddrString(sa)
+			}
+		})
+	}
+
+	lim := newLimiter(ctx, c.cd.rnd, c.cd.rate, c.cd.psize)
+	if lim == nil {
+		return nil
+	}
+	c.cd.setLimiter(lim)
+
+	p := make([]byte, c.cd.psize)
+	for {
+		if lim.WaitN(ctx, c.cd.psize) != nil {
+			break
+		}
+
+		if err := c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			return err
+		}
+		if _, err := c.conn.Write(p); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				c.cd.writeTimeouts++
+			}
+			return err
+		}
+		c.cd.sent++
+		s.sent(1)
+
+		for lim.AllowN(time.Now(), c.cd.psize) {
+			c.cd.nPacketsDropped++
+			s.dropped(1)
+		}
+
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.cd.pktTimeout)); err != nil {
+			return err
+		}
+		n, err := c.conn.Read(p)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue // A lost packet
+			}
+			return err
+		}
+
+		if c.cd.nPacketsReceived == 0 {
+			// First received packet _may_ contain a hostname
+			if i := bytes.IndexByte(p[:n], 0); i > 0 {
+				c.cd.host = string(p[:i])
+			}
+		}
+
+		c.cd.received(s, n)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------
+// DCCP server
+
+func (c *config) dccpServerMain() int {
+	laddr, err := net.ResolveTCPAddr("tcp", *c.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sa, family := dccpSockaddr(laddr)
+	f, err := dccpSocket(family)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rc, err := f.SyscallConn()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if serr = syscall.Bind(int(fd), sa); serr != nil {
+			serr = os.NewSyscallError("bind", serr)
+			return
+		}
+		if serr = syscall.Listen(int(fd), syscall.SOMAXCONN); serr != nil {
+			serr = os.NewSyscallError("listen", serr)
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Listen on DCCP address; ", *c.addr)
+
+	host := serverHost()
+
+	for {
+		var nfd int
+		err = rc.Read(func(fd uintptr) bool {
+			nfd, _, serr = syscall.Accept4(
+				int(fd), syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+			return serr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = serr
+		}
+		if err != nil {
+			log.Fatal(os.NewSyscallError("accept", err))
+		}
+		// A filler has state, e.g. the "fixed" pattern position
+		fill, err := newPayloadFiller(*c.payload)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go dccpServer(os.NewFile(uintptr(nfd), "dccp"), host, fill)
+	}
+}
+
+// dccpServer echoes packets with our hostname inserted
+func dccpServer(conn *os.File, host string, fill func(p []byte)) {
+	defer conn.Close()
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				debugf("DCCP server; %v", err)
+			}
+			return
+		}
+		if fill != nil {
+			fill(buf[:n])
+			if len(host) < n {
+				buf[len(host)] = 0
+			}
+		}
+		copy(buf[:n], host)
+		if _, err := conn.Write(buf[:n]); err != nil {
+			debugf("DCCP server; %v", err)
+			return
+		}
+	}
+}
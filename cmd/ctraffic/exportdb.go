@@ -0,0 +1,170 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+// Export of statistics to a SQLite database for ad-hoc SQL queries.
+// Durations are in nano-seconds, as in the json statistics.
+
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// The connections columns mirror the single value fields in
+// "connstats". "conn_index" is the index in
+// ConnStats and srtt_us is the last TCP info sample. The list fields
+// have their own tables. TestDBConnColumns checks that no field is
+// missing.
+var dbConnColumns = []string{
+	"conn_index INTEGER PRIMARY KEY",
+	"started_ns INTEGER",
+	"connect_ns INTEGER",
+	"ended_ns INTEGER",
+	"err TEXT",
+	"err_type TEXT",
+	"sent INTEGER",
+	"received INTEGER",
+	"dropped INTEGER",
+	"retransmits INTEGER",
+	"local TEXT",
+	"remote TEXT",
+	"host TEXT",
+	"server_conn_id INTEGER",
+	"rtt_ns INTEGER",
+	"srtt_us INTEGER",
+	"write_timeouts INTEGER",
+	"min_psize INTEGER",
+	"max_psize INTEGER",
+	"final_psize INTEGER",
+	"half_close_hang INTEGER",
+	"teardown_ms INTEGER",
+	"spoofed_replies INTEGER",
+	"ecn INTEGER",
+	"ecn_marks_seen INTEGER",
+	"owd_ns INTEGER",
+	"conn INTEGER",
+	"retries INTEGER",
+	"host_changes INTEGER",
+	"received_bytes INTEGER",
+	"assigned_rate_mbps REAL",
+}
+
+// The samples columns mirror "sample". "conn_index" is NULL for the
+// test samples and the index in ConnStats for connection samples.
+var dbSampleColumns = []string{
+	"conn_index INTEGER",
+	"time_ns INTEGER",
+	"sent INTEGER",
+	"received INTEGER",
+	"dropped INTEGER",
+	"received_bytes INTEGER",
+}
+
+// The TCP info history of the connections, "tcpinfoSample"
+var dbTCPInfoColumns = []string{
+	"conn_index INTEGER",
+	"time_ns INTEGER",
+	"rtt_us INTEGER",
+	"cwnd INTEGER",
+	"retransmits INTEGER",
+}
+
+// The -pkt_timestamp deltas of the connections
+var dbTimestampColumns = []string{
+	"conn_index INTEGER",
+	"delta_us INTEGER",
+}
+
+// The ping RTT histograms of the connections
+var dbRTTHistogramColumns = []string{
+	"conn_index INTEGER",
+	"bucket INTEGER",
+	"count INTEGER",
+}
+
+func dbCreate(tx *sql.Tx, table string, columns []string) *sql.Stmt {
+	if _, err := tx.Exec(
+		"CREATE TABLE " + table + " (" + strings.Join(columns, ", ") + ")"); err != nil {
+		log.Fatal(err)
+	}
+	marks := strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",")
+	stmt, err := tx.Prepare("INSERT INTO " + table + " VALUES (" + marks + ")")
+	if err != nil {
+		log.Fatal(err)
+	}
+	return stmt
+}
+
+func analyzeExportDB(s *statistics, path string) {
+	if path == "" {
+		log.Fatal("No -db_file specified")
+	}
+	// Tables in an existing database would be mixed up with the export
+	if _, err := os.Stat(path); err == nil {
+		log.Fatalf("-db_file %s exists", path)
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatal(err)
+	}
+	conns := dbCreate(tx, "connections", dbConnColumns)
+	samples := dbCreate(tx, "samples", dbSampleColumns)
+	tcpinfo := dbCreate(tx, "tcpinfo", dbTCPInfoColumns)
+	timestamps := dbCreate(tx, "timestamp_deltas", dbTimestampColumns)
+	rttHist := dbCreate(tx, "rtt_histogram", dbRTTHistogramColumns)
+	exec := func(stmt *sql.Stmt, args ...interface{}) {
+		if _, err := stmt.Exec(args...); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for i, c := range s.ConnStats {
+		var srtt interface{}
+		if n := len(c.TCPInfoHistory); n > 0 {
+			srtt = c.TCPInfoHistory[n-1].Rtt
+		}
+		exec(conns,
+			i, c.Started, c.Connect, c.Ended, c.Err, c.ErrType,
+			c.Sent, c.Received, c.Dropped, c.Retransmits,
+			c.Local, c.Remote, c.Host, c.ServerConnID, c.RTT, srtt,
+			c.WriteTimeouts, c.MinPsize, c.MaxPsize, c.FinalPsize,
+			c.HalfCloseHang, c.TeardownMs, c.SpoofedReplies,
+			c.ECN, c.ECNMarksSeen, c.OWD, c.Conn, c.Retries,
+			c.HostChanges, c.ReceivedBytes, c.AssignedRateMBps)
+		for _, samp := range c.Samples {
+			exec(samples,
+				i, samp.Time, samp.Sent, samp.Received, samp.Dropped, samp.ReceivedBytes)
+		}
+		for _, ti := range c.TCPInfoHistory {
+			exec(tcpinfo, i, ti.Time, ti.Rtt, ti.Cwnd, ti.Retransmits)
+		}
+		for _, d := range c.TimestampDeltaUs {
+			exec(timestamps, i, d)
+		}
+		for b, n := range c.RTTHistogram {
+			exec(rttHist, i, b, n)
+		}
+	}
+	for _, samp := range s.Samples {
+		exec(samples,
+			nil, samp.Time, samp.Sent, samp.Received, samp.Dropped, samp.ReceivedBytes)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Exported %d connections and %d samples to; %s\n",
+		len(s.ConnStats), len(s.Samples), path)
+}
@@ -0,0 +1,78 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+package main
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDBConnColumns(t *testing.T) {
+	// The list fields are exported to their own tables
+	tables := map[string]bool{
+		"Samples": true, "TCPInfoHistory": true, "TimestampDeltaUs": true,
+		"RTTHistogram": true,
+	}
+	typ := reflect.TypeOf(connstats{})
+	n := 0
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Type.Kind() == reflect.Slice {
+			if !tables[f.Name] {
+				t.Errorf("connstats.%s is not exported", f.Name)
+			}
+			continue
+		}
+		n++
+	}
+	// conn_index and srtt_us are added
+	if len(dbConnColumns) != n+2 {
+		t.Errorf("%d connections columns for %d connstats fields", len(dbConnColumns), n)
+	}
+}
+
+func TestExportDB(t *testing.T) {
+	s := &statistics{
+		ConnStats: []connstats{{
+			Sent:             2,
+			HostChanges:      1,
+			Samples:          []sample{{Time: time.Second, Sent: 1}},
+			TCPInfoHistory:   []tcpinfoSample{{Rtt: 100}, {Rtt: 200}},
+			TimestampDeltaUs: []int64{1, 2, 3},
+			RTTHistogram:     rttHistogram{0, 4},
+		}},
+		Samples: []sample{{Time: time.Second, Sent: 2}},
+	}
+	path := t.TempDir() + "/data.db"
+	analyzeExportDB(s, path)
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for table, expected := range map[string]int{
+		"connections": 1, "samples": 2, "tcpinfo": 2, "timestamp_deltas": 3,
+		"rtt_histogram": 2,
+	} {
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		if n != expected {
+			t.Errorf("%d rows in %s, expected %d", n, table, expected)
+		}
+	}
+	var hostChanges, srtt int
+	if err := db.QueryRow(
+		"SELECT host_changes, srtt_us FROM connections").Scan(&hostChanges, &srtt); err != nil {
+		t.Fatal(err)
+	}
+	if hostChanges != 1 || srtt != 200 {
+		t.Errorf("host_changes %d, srtt_us %d", hostChanges, srtt)
+	}
+}
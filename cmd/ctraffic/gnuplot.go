@@ -0,0 +1,108 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+// Export of plot data and a gnuplot script that renders PNG charts.
+// The data files have a header line which gnuplot uses as key titles.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const gnuplotScript = `# Generated by "ctraffic -analyze gnuplot". Render with;
+#   gnuplot ctraffic.gnuplot
+# The chart title may be given as an argument;
+#   gnuplot -c ctraffic.gnuplot "My title"
+title = %s
+if (ARGC > 0) title = ARG1
+
+set terminal png size 800,400
+set key autotitle columnhead
+set key outside
+set border 3
+set xtics nomirror
+set ytics nomirror
+set xlabel "Time (s)"
+set xrange [0:]
+
+set output "throughput.png"
+set title title." - throughput"
+set ylabel "KB/s"
+plot "throughput.dat" using 1:2 with lines lw 2
+
+set output "connections.png"
+set title title." - connections"
+set ylabel "Connections"
+set style fill solid 0.5 border -1
+set boxwidth 0.25 relative
+plot "connections.dat" using ($1-0.25):2 with boxes, \
+  "" using 1:3 with boxes, "" using ($1+0.25):4 with boxes
+
+set output "latency.png"
+set title title." - RTT"
+set xlabel "Connection start (s)"
+set ylabel "RTT (ms)"
+plot "latency.dat" using 1:2 with points pt 7 ps 0.5
+`
+
+// gnuplotDat writes a data file with space separated columns
+func gnuplotDat(dir, name string, f func(out *analyzeOut)) {
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		log.Fatal(err)
+	}
+	w := csv.NewWriter(file)
+	w.Comma = ' '
+	out := &analyzeOut{csv: w, file: file}
+	f(out)
+	out.flush()
+}
+
+// analyzeLatency writes the RTT of the connections by start time
+func analyzeLatency(s *statistics, out *analyzeOut) {
+	conns := make([]connstats, 0, len(s.ConnStats))
+	for _, c := range s.ConnStats {
+		if c.RTT > 0 {
+			conns = append(conns, c)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Started < conns[j].Started })
+	out.row("Time", "RTT")
+	for _, c := range conns {
+		out.row(c.Started.Seconds(), float64(c.RTT)/float64(time.Millisecond))
+	}
+}
+
+// analyzeGnuplot writes throughput, connections and latency data and a
+// script for the charts. The RunID is used as chart title.
+func analyzeGnuplot(s *statistics, dir string) {
+	if dir == "" {
+		log.Fatal("No -out_dir specified")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	gnuplotDat(dir, "throughput.dat", func(out *analyzeOut) { analyzeThroughput(s, out) })
+	gnuplotDat(dir, "connections.dat", func(out *analyzeOut) { analyzeConnections(s, out) })
+	gnuplotDat(dir, "latency.dat", func(out *analyzeOut) { analyzeLatency(s, out) })
+
+	title := s.RunID
+	if title == "" {
+		title = "ctraffic " + s.Started.Format(time.RFC3339)
+	}
+	script := filepath.Join(dir, "ctraffic.gnuplot")
+	if err := os.WriteFile(
+		script, []byte(fmt.Sprintf(gnuplotScript, strconv.Quote(title))), 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Render the charts with; cd %s && gnuplot ctraffic.gnuplot\n", dir)
+}
@@ -0,0 +1,218 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+// gRPC client and server. The service has one bidirectional streaming
+// RPC, "/ctraffic.Echo/Stream", where the server echoes the messages.
+// A well-known protobuf type is used for the messages so no generated
+// code is needed.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const grpcMethod = "/ctraffic.Echo/Stream"
+
+var grpcStreamDesc = grpc.StreamDesc{
+	StreamName:    "Stream",
+	Handler:       grpcEcho,
+	ServerStreams: true,
+	ClientStreams: true,
+}
+
+// ----------------------------------------------------------------------
+// gRPC client
+
+type grpcConn struct {
+	cd       *connData
+	cc       *grpc.ClientConn
+	conn     net.Conn // The first underlying TCP connection
+	connOnce sync.Once
+	stream   grpc.ClientStream
+	cancel   context.CancelFunc // Cancels the stream
+}
+
+func newGrpcConn(cd *connData) ctConn {
+	return &grpcConn{
+		cd: cd,
+	}
+}
+
+func (c *grpcConn) Connect(ctx context.Context, address string) error {
+	dctx, cancel := context.WithTimeout(ctx, c.cd.connectTimeout)
+	defer cancel()
+	dialer := func(ctx context.Context, address string) (net.Conn, error) {
+		// Re-dials are done in grpc goroutines, not in the "-netns"
+		// namespace of Connect()
+		d := net.Dialer{LocalAddr: c.cd.localAddr}
+		var conn net.Conn
+		err := inNetns(func() (err error) {
+			conn, err = d.DialContext(ctx, "tcp", address)
+			return err
+		})
+		if err == nil {
+			// The dialer is called again on re-dials by grpc
+			c.connOnce.Do(func() { c.conn = conn })
+		}
+		return conn, err
+	}
+	var err error
+	c.cc, err = grpc.DialContext(
+		dctx, address, grpc.WithBlock(), grpc.WithContextDialer(dialer),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return err
+	}
+	// The stream lives until the test ends, or is cancelled on a
+	// packet timeout
+	sctx, cancel := context.WithCancel(ctx)
+	c.stream, err = c.cc.NewStream(sctx, &grpcStreamDesc, grpcMethod)
+	if err != nil {
+		cancel()
+		c.cc.Close()
+		return err
+	}
+	c.cancel = cancel
+	return nil
+}
+
+func (c *grpcConn) Run(ctx context.Context, s *statistics) error {
+	defer c.cc.Close()
+	defer c.cancel()
+
+	if c.conn != nil {
+		c.cd.local = c.conn.LocalAddr().String()
+		c.cd.remote = c.conn.RemoteAddr().String()
+	}
+
+	lim := newLimiter(ctx, c.cd.rnd, c.cd.rate, c.cd.psize)
+	if lim == nil {
+		return nil
+	}
+	c.cd.setLimiter(lim)
+
+	req := &wrapperspb.BytesValue{Value: make([]byte, c.cd.psize)}
+	rsp := new(wrapperspb.BytesValue)
+	var rttSum time.Duration
+
+	// The stream is cancelled if a reply is not received within
+	// -pkt_timeout. The timer is re-used since AfterFunc() allocates.
+	var timedOut int32
+	timer := time.AfterFunc(time.Hour, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		c.cancel()
+	})
+	timer.Stop()
+	defer timer.Stop()
+	streamErr := func(err error) error {
+		if atomic.LoadInt32(&timedOut) != 0 {
+			return os.ErrDeadlineExceeded
+		}
+		return err
+	}
+
+	for {
+		if lim.WaitN(ctx, c.cd.psize) != nil {
+			break
+		}
+
+		sent := time.Now()
+		if err := c.stream.SendMsg(req); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return streamErr(err)
+		}
+		c.cd.sent++
+		s.sent(1)
+
+		for lim.AllowN(time.Now(), c.cd.psize) {
+			c.cd.nPacketsDropped++
+			s.dropped(1)
+		}
+
+		timer.Reset(c.cd.pktTimeout)
+		err := c.stream.RecvMsg(rsp)
+		timer.Stop()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return streamErr(err)
+		}
+		rttSum += time.Since(sent)
+
+		if c.cd.nPacketsReceived == 0 {
+			// First received message _may_ contain a hostname
+			if n := bytes.IndexByte(rsp.Value, 0); n > 0 {
+				c.cd.host = string(rsp.Value[:n])
+			}
+		}
+
+		c.cd.received(s, len(rsp.Value))
+	}
+
+	c.stream.CloseSend()
+	if c.cd.nPacketsReceived > 0 {
+		c.cd.rtt = rttSum / time.Duration(c.cd.nPacketsReceived)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------
+// gRPC server
+
+func (c *config) grpcServerMain() int {
+	l, err := net.Listen("tcp", *c.grpcAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Listen on gRPC address; ", *c.grpcAddr)
+
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "ctraffic.Echo",
+		HandlerType: (*interface{})(nil),
+		Streams:     []grpc.StreamDesc{grpcStreamDesc},
+	}, nil)
+	if err := srv.Serve(l); err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
+
+// grpcEcho echoes messages with our hostname inserted in the first one
+func grpcEcho(_ interface{}, stream grpc.ServerStream) error {
+	host := serverHost()
+	m := new(wrapperspb.BytesValue)
+	for first := true; ; first = false {
+		if err := stream.RecvMsg(m); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if first {
+			if n := copy(m.Value, host); n < len(m.Value) {
+				m.Value[n] = 0
+			}
+		}
+		if err := stream.SendMsg(m); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// stalledGrpcServer starts a gRPC server that never replies
+func stalledGrpcServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "ctraffic.Echo",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName: "Stream",
+			Handler: func(_ interface{}, stream grpc.ServerStream) error {
+				m := new(wrapperspb.BytesValue)
+				for {
+					if err := stream.RecvMsg(m); err != nil {
+						return err
+					}
+				}
+			},
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+	}, nil)
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	return l.Addr().String()
+}
+
+func TestGrpcPacketTimeout(t *testing.T) {
+	addr := stalledGrpcServer(t)
+	runTestClient(t, "-address", addr, "-client", "grpc", "-pkt_timeout", "200ms",
+		"-reconnect=false", "-timeout", "3s", "-rate", "10")
+	if nConn != 1 {
+		t.Fatalf("%d connections", nConn)
+	}
+	if errType(cData[0].err) != "timeout" {
+		t.Errorf("Connection error %v, expected a timeout", cData[0].err)
+	}
+}
@@ -8,26 +8,40 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
+	"math/bits"
 	"math/rand"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
+	"unsafe"
 
 	rndip "github.com/Nordix/mconnect/pkg/rndip/v2"
 	tcpinfo "github.com/brucespang/go-tcpinfo"
+	"golang.org/x/sys/unix"
 	"golang.org/x/time/rate"
 
+	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
 	"golang.org/x/net/ipv6"
 )
@@ -51,24 +65,115 @@ type addressGenerator interface {
 }
 
 type config struct {
-	isServer  *bool
-	addr      *string
-	nconn     *int
-	retries   *int
-	version   *bool
-	timeout   *time.Duration
-	monitor   *bool
-	udp       *bool
-	psize     *int
-	rate      *float64
-	reconnect *bool
-	ctype     *string
-	stats     *string
-	statsFile *string
-	analyze   *string
-	srccidr   *string
-	srcfile   *string
-	adrgen    addressGenerator
+	isServer   *bool
+	addr       *string
+	nconn      *int
+	retries    *int
+	version    *bool
+	timeout    *time.Duration
+	continuous *bool
+	monitor    *bool
+	udp        *bool
+	psize      *int
+	rate       *float64
+	reconnect  *bool
+	ctype      *string
+	stats      *string
+	statsFile  *string
+	analyze    *string
+	srccidr    *string
+	srcfile    *string
+	csvFile    *string
+	cSamples   *bool
+	tiIval     *time.Duration
+	goroutines *int
+	debug      *bool
+	adaptive   *bool
+	psizeMin   *int
+	psizeMax   *int
+	rttTarget  *time.Duration
+	mtuProbe   *bool
+	ecn        *bool
+	serverEcn  *bool
+	halfClose  *bool
+	udpGso     *int
+	flowTmo    *time.Duration
+	udpRcvbuf  *int
+	udpSndbuf  *int
+	stagger    *time.Duration
+	drainTmo   *time.Duration
+	payload    *string
+	runID      *string
+	connTmo    *time.Duration
+	idleTmo    *time.Duration
+	maxSndbuf  *int
+	statIntvl  *time.Duration
+	failLoss   *float64
+	failConns  *int
+	failRetr   *int
+	lossPct    *float64
+	protocol   *string
+	waitClose  *bool
+	limit      *int
+	clientMix  *string
+	grpcAddr   *string
+	backlog    *int
+	cpuAff     *string
+	dnsTmo     *time.Duration
+	sctpStrms  *int
+	sctpOrder  *bool
+	retryOn    *string
+	burst      *int
+	recvRate   *float64
+	owd        *bool
+	srvProc    *time.Duration
+	rateDist   *string
+	rateStart  *string
+	netnsPath  *string
+	family     *string
+	srcMode    *string
+	connLog    *string
+	maxSamples *int
+	deltaIval  *time.Duration
+	deltaFile  *string
+	denyCidr   *string
+	serverID   *string
+	dbFile     *string
+	traceFile  *string
+	cfgFile    *string
+	maxNconn   *int
+	cpuProf    *string
+	memProf    *string
+	window     *int
+	files      *string
+	readBuf    *int
+	srvStats   *string
+	maxClients *int
+	srvMaxPkt  *int
+	pushGw     *string
+	acceptRate *float64
+	pktTs      *bool
+	failover   *string
+	pktTmo     *time.Duration
+	outDir     *string
+	topN       *int
+	metric     *string
+	srvTiming  *bool
+	ratePct    *float64
+	warnTW     *int
+	acceptLog  *bool
+	sendJitter *time.Duration
+	retryDelay *time.Duration
+	alwaysID   *bool
+	replayFile *string
+	replay     *string
+	recorder   *replayRecorder
+	player     *replayPlayer
+	reload     *reloader
+	clog       *connLogger
+	adrgen     addressGenerator
+	daddrs     []string
+	notify     func(c chan<- os.Signal, sig ...os.Signal) // signal.Notify
 }
 
 func main() {
@@ -77,25 +182,7 @@ func main() {
 		flag.PrintDefaults()
 	}
 
-	var cmd config
-	cmd.isServer = flag.Bool("server", false, "Act as server")
-	cmd.ctype = flag.String("client", "echo", "echo")
-	cmd.statsFile = flag.String("stat_file", "", "File for post-test analyzing")
-	cmd.addr = flag.String("address", "[::1]:5003", "Server address")
-	cmd.nconn = flag.Int("nconn", 1, "Number of connections")
-	cmd.retries = flag.Int("retries", 10, "Number of re-connection retries")
-	cmd.version = flag.Bool("version", false, "Print version and quit")
-	cmd.timeout = flag.Duration("timeout", 10*time.Second, "Timeout")
-	cmd.monitor = flag.Bool("monitor", false, "Monitor")
-	cmd.psize = flag.Int("psize", 1024, "Packet size")
-	cmd.rate = flag.Float64("rate", 10.0, "Rate in KB/second")
-	cmd.reconnect = flag.Bool("reconnect", true, "Re-connect on failures")
-	cmd.stats = flag.String("stats", "summary", "none|summary|all")
-	cmd.analyze = flag.String("analyze", "throughput", "Post-test analyze throughput|hosts|connections")
-	cmd.srccidr = flag.String("srccidr", "", "Source CIDR")
-	cmd.udp = flag.Bool("udp", false, "Use UDP")
-	cmd.srcfile = flag.String("srcfile", "", "Sources from file")
-
+	cmd := newConfig(flag.CommandLine)
 	flag.Parse()
 	if len(os.Args) < 2 {
 		flag.Usage()
@@ -106,29 +193,319 @@ func main() {
 		fmt.Println(version)
 		os.Exit(0)
 	}
+	if *cmd.cfgFile != "" {
+		loadConfig(*cmd.cfgFile)
+	}
+
+	cmd.setup(flag.CommandLine)
+
+	stop := cmd.startProfiles()
+	rc := cmd.run()
+	stop()
+	os.Exit(rc)
+}
+
+// newConfig defines the options in a flag set
+func newConfig(fs *flag.FlagSet) *config {
+	var c config
+	c.notify = signal.Notify
+	c.isServer = fs.Bool("server", false, "Act as server")
+	c.ctype = fs.String("client", "echo", "echo|ping|grpc")
+	c.statsFile = fs.String("stat_file", "", "File for post-test analyzing")
+	c.addr = fs.String("address", "[::1]:5003", "Server address. Clients take a comma separated list")
+	c.nconn = fs.Int("nconn", 1, "Number of connections")
+	c.retries = fs.Int("retries", 10, "Number of re-connection retries")
+	c.version = fs.Bool("version", false, "Print version and quit")
+	c.timeout = fs.Duration("timeout", 10*time.Second, "Timeout")
+	c.monitor = fs.Bool("monitor", false, "Monitor")
+	c.psize = fs.Int("psize", 1024, "Packet size")
+	c.rate = fs.Float64("rate", 10.0, "Rate in KB/second")
+	c.reconnect = fs.Bool("reconnect", true, "Re-connect on failures")
+	c.stats = fs.String("stats", "summary", "none|summary|all")
+	c.analyze = fs.String("analyze", "throughput", "Post-test analyze throughput|throughput_window|hosts|affinity|connections|conntput|ecn|gantt|failrate|topfail|export_db|retrans_corr|start_dist|host_rtt_diff|gnuplot|topn")
+	c.srccidr = fs.String("srccidr", "", "Source CIDR")
+	c.udp = fs.Bool("udp", false, "Use UDP")
+	c.srcfile = fs.String("srcfile", "", "Sources from file")
+	c.cSamples = fs.Bool("conn_samples", false, "Collect samples per connection (requires -stats all)")
+	c.tiIval = fs.Duration("tcpinfo_interval", 0, "Interval for TCP info sampling per connection, 0 = disabled (requires -stats all)")
+	c.goroutines = fs.Int("goroutines", 0, "Max client goroutines, 0 = one per connection. Other connections wait for a free goroutine")
+	c.debug = fs.Bool("debug", false, "Debug printouts")
+	c.adaptive = fs.Bool("adaptive_psize", false, "Adapt the packet size to the RTT")
+	c.psizeMin = fs.Int("psizemin", 64, "Min packet size with -adaptive_psize")
+	c.psizeMax = fs.Int("psizemax", 64*1024, "Max packet size with -adaptive_psize")
+	c.rttTarget = fs.Duration("rtt_target", 10*time.Millisecond, "Target RTT with -adaptive_psize")
+	c.mtuProbe = fs.Bool("mtu_probe", false, "Probe the path MTU with UDP packets. Failing sizes are bisected")
+	c.ecn = fs.Bool("ecn", false, "Request ECN and record CE marks per connection")
+	c.serverEcn = fs.Bool("server_ecn", false, "Log ECN state of server connections")
+	c.halfClose = fs.Bool("half_close", false, "Half-close connections at test end and check that the server closes")
+	c.failover = fs.String("server_failover", "", "Ordered server addresses, used instead of -address. Connections fail over to the next")
+	c.pktTs = fs.Bool("pkt_timestamp", false, "Record the delay from the kernel receive timestamp of UDP packets until read")
+	c.udpGso = fs.Int("udp_gso", 0, "UDP GSO segment size (packet size), 0 = disabled")
+	c.flowTmo = fs.Duration("flow_timeout", time.Minute, "Expire time for UDP server flows")
+	c.udpRcvbuf = fs.Int("udp_rcvbuf", 0, "UDP socket receive buffer size, 0 = OS default")
+	c.udpSndbuf = fs.Int("udp_sndbuf", 0, "UDP socket send buffer size, 0 = OS default")
+	c.stagger = fs.Duration("stagger", 0, "Delay between connection starts. -timeout is extended by the total delay")
+	c.drainTmo = fs.Duration("drain_timeout", 30*time.Second, "Server max wait for connections to end after SIGUSR1")
+	c.payload = fs.String("server_payload", "echo", "Server response echo|zeros|random|fixed:hexstring")
+	c.runID = fs.String("run_id", "", "Test run id stored in the statistics")
+	c.connTmo = fs.Duration("connect_timeout", 1500*time.Millisecond, "Connect timeout")
+	c.idleTmo = fs.Duration("idle_timeout", 0, "Re-connect if no packet can be sent within this time, 0 = disabled")
+	c.maxSndbuf = fs.Int("max_send_buffer", 0, "TCP socket send buffer size, 0 = OS default")
+	c.statIntvl = fs.Duration("stat_interval", time.Second, "Statistics sample interval, min 100ms")
+	c.failLoss = fs.Float64("fail_on_loss", -1, "Exit with code 2 if the packet loss exceeds this percentage, <0 = disabled")
+	c.failConns = fs.Int("fail_on_failed_conns", -1, "Exit with code 2 if failed connections exceed this, <0 = disabled")
+	c.failRetr = fs.Int("fail_on_retransmits", -1, "Exit with code 2 if retransmits exceed this, <0 = disabled")
+	c.lossPct = fs.Float64("client_loss_pct", 0, "Simulated client packet loss in percent, for testing")
+	c.protocol = fs.String("protocol", "tcp", "tcp|udp|dccp|sctp")
+	c.waitClose = fs.Bool("wait_close", false, "Half-close connections at test end and wait for the server close (max 500ms)")
+	c.limit = fs.Int("limit", 50, "Max connections shown by -analyze gantt|topfail")
+	c.clientMix = fs.String("client_mix", "", "Client types as percent of -nconn, e.g. echo:70%,ping:30%")
+	c.grpcAddr = fs.String("grpc_address", "", "Server gRPC listen address, e.g. :5004, empty = disabled")
+	c.backlog = fs.Int("backlog", 0, "Server listen backlog, 0 = OS default (net.core.somaxconn)")
+	c.cpuAff = fs.String("cpu_affinity", "", "Client CPUs, e.g. 0,1,2. Only the process threads are bound, not the Go scheduler")
+	c.dnsTmo = fs.Duration("dns_timeout", 5*time.Second, "Timeout for each destination address lookup")
+	c.sctpStrms = fs.Int("sctp_streams", 1, "Number of SCTP streams")
+	c.sctpOrder = fs.Bool("sctp_ordered", true, "Ordered SCTP delivery")
+	c.retryOn = fs.String("retry_on", "any", "Errors that trigger re-connect/connect retry; eof,reset,timeout,refused,any")
+	c.burst = fs.Int("burst_size", 0, "Rate limiter burst in bytes, min one packet. 0 = 10 packets")
+	c.recvRate = fs.Float64("recv_rate", 0, "Receive rate in KB/second to simulate a slow consumer, 0 = unlimited")
+	c.owd = fs.Bool("owd", false, "Timestamp packets and estimate the one-way delay")
+	c.srvProc = fs.Duration("server_proc_time", 0, "Known server processing time, subtracted with -owd")
+	c.rateDist = fs.String("rate_distribution", "", "Per-connection rate (KB/s) distribution uniform:min,max|pareto:alpha, default -rate/-nconn")
+	c.rateStart = fs.String("rate_start", "full", "Limiter start full (bucket drained, no burst)|empty (burst at start)|random")
+	c.netnsPath = fs.String("netns", "", "Client network namespace, a path or a name in /var/run/netns")
+	c.family = fs.String("prefer_family", "auto", "Address family for host names ipv4|ipv6|auto (ipv6 if available, all addresses of a single host)")
+	c.srcMode = fs.String("src_mode", "sequential", "Source selection from -srcfile sequential|weighted (lines \"address<tab>weight\")")
+	c.connLog = fs.String("conn_log", "", "Write connection state transitions as JSON lines to this file")
+	c.maxSamples = fs.Int("max_samples", 0, "Max statistics samples, 0 is unlimited")
+	c.deltaIval = fs.Duration("delta_interval", 0, "Interval for delta statistics, 0 is off")
+	c.deltaFile = fs.String("delta_file", "", "Write delta statistics as JSON lines to this file")
+	c.denyCidr = fs.String("server_deny_cidr", "", "Server closes connections from these comma separated CIDRs")
+	c.serverID = fs.String("server_id", "", "Server id sent instead of the hostname, max 63 bytes")
+	c.dbFile = fs.String("db_file", "", "SQLite database file for -analyze export_db")
+	c.traceFile = fs.String("trace_file", "", "Write a runtime trace to this file, see \"go tool trace\"")
+	c.cfgFile = fs.String("config", "", "Config file with \"flag value\" lines. -rate and -nconn are reloaded on SIGHUP")
+	c.maxNconn = fs.Int("max_nconn", 0, "Max -nconn on reload, 0 = -nconn")
+	c.cpuProf = fs.String("cpu_profile", "", "Write a CPU profile to this file")
+	c.memProf = fs.String("mem_profile", "", "Write a heap profile to this file at exit")
+	c.files = fs.String("files", "", "Two statistics files for -analyze host_rtt_diff, \"a.json,b.json\"")
+	c.window = fs.Int("window", 1, "Seconds in the moving average for -analyze throughput_window")
+	c.srvTiming = fs.Bool("server_timing", false, "Server measures the processing time of -psize packets on TCP")
+	c.ratePct = fs.Float64("rate_pct", 0, "Rate in percent of the interface speed, instead of -rate")
+	c.warnTW = fs.Int("warn_timewait", 0, "Warn if more client sockets than this are in TIME_WAIT after the test, 0 is off")
+	c.acceptLog = fs.Bool("server_accept_log", false, "Server prints accepted connections per second on stderr")
+	c.acceptRate = fs.Float64("server_conn_rate", 0, "Server max accepted connections per second, 0 = unlimited")
+	c.sendJitter = fs.Duration("send_jitter", 0, "Random delay 0-send_jitter before each packet is sent")
+	c.retryDelay = fs.Duration("retry_delay", 0, "Delay before re-connect after a failed connection")
+	c.alwaysID = fs.Bool("server_always_id", false, "Server sends its id in every -psize packet. Clients read it")
+	c.replayFile = fs.String("replay_file", "", "Record the connection sequence to this file")
+	c.replay = fs.String("replay", "", "Replay a connection sequence recorded with -replay_file")
+	c.readBuf = fs.Int("read_buf", 0, "Client read buffer size in bytes, 0 = -psize (unbuffered)")
+	c.srvStats = fs.String("server_stats_file", "", "Server writes per-client statistics to this file at shutdown")
+	c.maxClients = fs.Int("server_max_clients", 10000, "Max disconnected clients kept in the server per-client statistics")
+	c.srvMaxPkt = fs.Int("server_max_pkt", 65535, "Server max packet size in bytes. Larger UDP packets are discarded")
+	c.pushGw = fs.String("push_gateway", "", "Push the final statistics to this Prometheus Pushgateway url")
+	c.pktTmo = fs.Duration("pkt_timeout", time.Second, "Max wait for the echo of a packet")
+	c.outDir = fs.String("out_dir", "", "Directory for -analyze gnuplot files")
+	c.topN = fs.Int("n", 10, "Number of connections shown by -analyze topn")
+	c.metric = fs.String("metric", "throughput", "Sort metric for -analyze topn throughput|rtt|retransmits|loss")
+	c.continuous = fs.Bool("continuous", false, "Run the client until SIGINT/SIGTERM, -timeout is ignored")
+	c.csvFile = fs.String("analyze_out_csv", "", "Write analyze output also as CSV to this file. \"-\" writes only CSV to stdout")
+	return &c
+}
+
+// setup checks the options and sets globals. It is called after the
+// options are parsed.
+func (c *config) setup(fs *flag.FlagSet) {
+	debug = *c.debug
+	if len(*c.serverID) > 63 {
+		log.Fatal("Max -server_id length is 63")
+	}
+	serverID = *c.serverID
+	burstSize = *c.burst
+	switch *c.rateStart {
+	case "full", "empty", "random":
+		rateStart = *c.rateStart
+	default:
+		log.Fatal("Unsupported rate_start; ", *c.rateStart)
+	}
+
+	switch *c.protocol {
+	case "tcp":
+	case "udp":
+		*c.udp = true
+	case "dccp", "sctp":
+		if *c.udp {
+			log.Fatal("-udp can't be used with -protocol ", *c.protocol)
+		}
+	default:
+		log.Fatal("Unsupported protocol; ", *c.protocol)
+	}
+	if (*c.replay != "" || *c.replayFile != "") && (*c.udp || *c.mtuProbe) {
+		// The connection sequence is made by the client pool
+		log.Fatal("-replay and -replay_file can't be used with -udp or -mtu_probe")
+	}
 
-	if *cmd.psize < 64 {
+	if *c.udpGso > 0 {
+		// The GSO segment size is the packet size
+		*c.psize = *c.udpGso
+	}
+	if *c.deltaIval > 0 && *c.deltaFile == "" {
+		log.Fatal("-delta_interval requires -delta_file")
+	}
+	if *c.pktTmo <= 0 {
+		log.Fatal("-pkt_timeout must be > 0")
+	}
+	if *c.readBuf < 0 {
+		log.Fatal("-read_buf must be >= 0")
+	}
+	if *c.rate < 0 {
+		log.Fatal("-rate must be >= 0")
+	}
+	if *c.maxNconn == 0 {
+		*c.maxNconn = *c.nconn
+	} else if *c.maxNconn < *c.nconn {
+		log.Fatal("-max_nconn must be >= -nconn")
+	}
+	if *c.goroutines < 0 {
+		log.Fatal("-goroutines must be >= 0")
+	}
+	if *c.continuous {
+		*c.timeout = forever
+	} else if *c.stagger > 0 && !*c.udp && *c.nconn > 1 {
+		// The last connection shall also run for -timeout
+		*c.timeout += *c.stagger * time.Duration(*c.nconn-1)
+	}
+	if *c.failover != "" && *c.udp {
+		log.Fatal("-server_failover is not supported with -udp")
+	}
+	if *c.pktTs && !*c.udp {
+		log.Fatal("-pkt_timestamp requires -udp")
+	}
+	if *c.acceptRate < 0 {
+		log.Fatal("-server_conn_rate must be >= 0")
+	}
+	if *c.srvMaxPkt <= 0 {
+		log.Fatal("-server_max_pkt must be > 0")
+	}
+	if *c.maxClients < 0 {
+		log.Fatal("-server_max_clients must be >= 0")
+	}
+	if *c.isServer && (*c.srvTiming || *c.alwaysID) && *c.psize > *c.srvMaxPkt {
+		// The server splits the stream in -psize packets. A client
+		// with -server_always_id is not limited
+		log.Fatal("-psize must be <= -server_max_pkt")
+	}
+	if *c.ratePct != 0 {
+		if *c.ratePct < 0 || *c.ratePct > 100 {
+			log.Fatal("-rate_pct must be 0-100")
+		}
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "rate" {
+				log.Fatal("-rate and -rate_pct can't both be used")
+			}
+		})
+	}
+	if *c.alwaysID && *c.owd {
+		log.Fatal("-server_always_id can't be used with -owd")
+	}
+	if *c.statIntvl < 100*time.Millisecond {
+		*c.statIntvl = 100 * time.Millisecond
+	}
+	switch *c.family {
+	case "ipv4", "ipv6", "auto":
+	default:
+		log.Fatal("Unsupported prefer_family; ", *c.family)
+	}
+	for _, e := range strings.Split(*c.retryOn, ",") {
+		switch e {
+		case "eof", "reset", "timeout", "refused", "any":
+		default:
+			log.Fatal("Unsupported retry_on; ", e)
+		}
+	}
+	if *c.sctpStrms < 1 {
+		*c.sctpStrms = 1
+	}
+	if *c.psize < 64 {
 		// Must hold a hostname
-		*cmd.psize = 64
+		*c.psize = 64
+	}
+	if *c.psizeMin < 64 {
+		*c.psizeMin = 64
 	}
+	if *c.psizeMax < *c.psizeMin {
+		*c.psizeMax = *c.psizeMin
+	}
+}
 
-	if *cmd.statsFile != "" {
-		os.Exit(cmd.analyzeMain())
-	} else if *cmd.isServer {
-		if *cmd.udp {
-			go cmd.udpServerMain()
+// startProfiles starts the CPU profile. The returned function stops
+// it and writes the heap profile.
+func (c *config) startProfiles() func() {
+	var cpuFile *os.File
+	if *c.cpuProf != "" {
+		var err error
+		if cpuFile, err = os.Create(*c.cpuProf); err != nil {
+			log.Fatal(err)
 		}
-		os.Exit(cmd.serverMain())
-	} else {
-		if *cmd.udp {
-			os.Exit(cmd.udpClientMain())
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	return func() {
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			cpuFile.Close()
+		}
+		if *c.memProf != "" {
+			file, err := os.Create(*c.memProf)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer file.Close()
+			runtime.GC() // Up-to-date statistics
+			if err := pprof.WriteHeapProfile(file); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+func (c *config) run() int {
+	if *c.statsFile != "" || *c.files != "" {
+		return c.analyzeMain()
+	}
+	if *c.isServer {
+		if _, err := newPayloadFiller(*c.payload); err != nil {
+			log.Fatal(err)
+		}
+		if *c.udp {
+			go c.udpServerMain()
+		}
+		switch *c.protocol {
+		case "dccp":
+			go c.dccpServerMain()
+		case "sctp":
+			go c.sctpServerMain()
+		}
+		if *c.grpcAddr != "" {
+			go c.grpcServerMain()
 		}
-		os.Exit(cmd.clientMain())
+		return c.serverMain()
 	}
+	if *c.mtuProbe {
+		return c.mtuProbeMain()
+	}
+	if *c.udp {
+		return c.udpClientMain()
+	}
+	return c.clientMain()
 }
 
+// addrPool hands out the addresses in order and wraps around
 type addrPool struct {
 	addresses []string
+	next      uint32
 }
 
 func readAddresses(path string) *addrPool {
@@ -147,82 +524,318 @@ func readAddresses(path string) *addrPool {
 	return &addrPool{addresses: lines}
 }
 
+// GetIPStringIdx ignores the cursor. An atomic cursor is used since
+// the connection id may not be unique for an address, e.g. on
+// re-connects.
 func (p *addrPool) GetIPStringIdx(cursor uint32) string {
-	if int(cursor) < len(p.addresses) {
-		adr := p.addresses[cursor]
-		return adr
+	if len(p.addresses) == 0 {
+		return ""
 	}
-	return ""
+	i := atomic.AddUint32(&p.next, 1) - 1
+	return p.addresses[i%uint32(len(p.addresses))]
 }
 
-// Add port ":0" if needed
-func withPort(adr string) string {
-	if strings.ContainsAny(adr, "[]") {
-		if strings.Contains(adr, "]:") {
-			return adr
-		}
-	} else {
-		if strings.ContainsAny(adr, ":") {
-			return adr
+func (c *config) readSources() addressGenerator {
+	switch *c.srcMode {
+	case "sequential":
+		return readAddresses(*c.srcfile)
+	case "weighted":
+		return readWeightedAddresses(*c.srcfile)
+	}
+	log.Fatal("Unsupported src_mode; ", *c.srcMode)
+	return nil
+}
+
+// weightedPool draws addresses at random in proportion to their weight
+type weightedPool struct {
+	addresses []string
+	cumWeight []float64
+}
+
+func readWeightedAddresses(path string) *weightedPool {
+	p := &weightedPool{}
+	var sum float64
+	for _, line := range readAddresses(path).addresses {
+		adr, w, found := strings.Cut(line, "\t")
+		weight := 1.0
+		if found {
+			var err error
+			if weight, err = strconv.ParseFloat(strings.TrimSpace(w), 64); err != nil || weight < 0 {
+				log.Fatal("Invalid weight; ", line)
+			}
 		}
+		sum += weight
+		p.addresses = append(p.addresses, adr)
+		p.cumWeight = append(p.cumWeight, sum)
+	}
+	if sum == 0 {
+		log.Fatal("No weighted addresses in; ", path)
+	}
+	return p
+}
+
+// GetIPStringIdx ignores the cursor, addresses are re-used
+func (p *weightedPool) GetIPStringIdx(cursor uint32) string {
+	r := rand.Float64() * p.cumWeight[len(p.cumWeight)-1]
+	i := sort.Search(len(p.cumWeight), func(i int) bool { return p.cumWeight[i] > r })
+	if i == len(p.addresses) {
+		i--
+	}
+	return p.addresses[i]
+}
+
+// Add port ":0" if needed. A bare IPv6 address is bracketed.
+func withPort(adr string) string {
+	if _, _, err := net.SplitHostPort(adr); err == nil {
+		return adr
+	}
+	return net.JoinHostPort(strings.Trim(adr, "[]"), "0")
+}
+
+var debug bool
+
+// serverID is sent by servers instead of the hostname if set
+var serverID string
+
+func serverHost() string {
+	if serverID != "" {
+		return serverID
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+func debugf(format string, v ...interface{}) {
+	if debug {
+		log.Printf(format, v...)
 	}
-	return fmt.Sprintf("%s:0", adr)
 }
 
 // ----------------------------------------------------------------------
 // Analyze
 
-func (c *config) analyzeMain() int {
-
-	// Read statistics
+// readStatsFile reads statistics from a file, "-" is stdin
+func readStatsFile(path string) *statistics {
 	var err error
 	var s *statistics
-	if *c.statsFile == "-" {
+	if path == "-" {
 		s, err = readStats(os.Stdin)
 	} else {
-		if file, e := os.Open(*c.statsFile); e != nil {
+		if file, e := os.Open(path); e != nil {
 			log.Fatal(e)
 		} else {
+			defer file.Close()
 			s, err = readStats(file)
 		}
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	return s
+}
+
+func (c *config) analyzeMain() int {
+
+	out := c.newAnalyzeOut()
+	defer out.flush()
+
+	if *c.analyze == "host_rtt_diff" {
+		// Compares two files given with -files instead of -stat_file
+		files := strings.Split(*c.files, ",")
+		if len(files) != 2 {
+			log.Fatal("-analyze host_rtt_diff requires -files a.json,b.json")
+		}
+		analyzeHostRttDiff(readStatsFile(files[0]), readStatsFile(files[1]), out)
+		return 0
+	}
+
+	// Read statistics
+	s := readStatsFile(*c.statsFile)
 
 	switch *c.analyze {
 	case "throughput":
-		analyzeThroughput(s)
+		analyzeThroughput(s, out)
+	case "throughput_window":
+		analyzeThroughputWindow(s, out, *c.window)
 	case "connections":
-		analyzeConnections(s)
+		analyzeConnections(s, out)
+	case "conntput":
+		analyzeConnThroughput(s, out)
+	case "failrate":
+		analyzeFailRate(s, out)
+	case "ecn":
+		if out.csv != nil {
+			log.Fatal("CSV output not supported for; ", *c.analyze)
+		}
+		analyzeEcn(s)
 	case "hosts":
+		if out.csv != nil {
+			log.Fatal("CSV output not supported for; ", *c.analyze)
+		}
 		analyzeHosts(s)
+	case "affinity":
+		if out.csv != nil {
+			log.Fatal("CSV output not supported for; ", *c.analyze)
+		}
+		analyzeAffinity(s)
+	case "gantt":
+		if out.csv != nil {
+			log.Fatal("CSV output not supported for; ", *c.analyze)
+		}
+		analyzeGantt(s, *c.limit)
+	case "topfail":
+		analyzeTopFail(s, out, *c.limit)
+	case "topn":
+		analyzeTopN(s, out, *c.topN, *c.metric)
+	case "export_db":
+		analyzeExportDB(s, *c.dbFile)
+	case "gnuplot":
+		analyzeGnuplot(s, *c.outDir)
+	case "start_dist":
+		if out.csv != nil {
+			log.Fatal("CSV output not supported for; ", *c.analyze)
+		}
+		analyzeStartDist(s)
+	case "retrans_corr":
+		if out.csv != nil {
+			log.Fatal("CSV output not supported for; ", *c.analyze)
+		}
+		analyzeRetransCorr(s)
 	default:
 		log.Fatal("Unsupported anayze; ", *c.analyze)
 	}
 	return 0
 }
 
-func analyzeThroughput(s *statistics) {
+// analyzeOut writes rows of analyze data. The first row is the header.
+// Rows are printed in human-readable format on stdout and/or as CSV
+// (RFC4180) depending on the "-analyze_out_csv" option.
+type analyzeOut struct {
+	human bool
+	csv   *csv.Writer
+	file  *os.File
+}
+
+func (c *config) newAnalyzeOut() *analyzeOut {
+	out := &analyzeOut{human: true}
+	switch *c.csvFile {
+	case "":
+	case "-":
+		out.human = false
+		out.csv = csv.NewWriter(os.Stdout)
+	default:
+		file, err := os.Create(*c.csvFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		out.file = file
+		out.csv = csv.NewWriter(file)
+	}
+	return out
+}
+
+func (o *analyzeOut) row(fields ...interface{}) {
+	if o.human {
+		fmt.Println(fields...)
+	}
+	if o.csv != nil {
+		rec := make([]string, len(fields))
+		for i, f := range fields {
+			rec[i] = fmt.Sprint(f)
+		}
+		if err := o.csv.Write(rec); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func (o *analyzeOut) flush() {
+	if o.csv != nil {
+		o.csv.Flush()
+		if err := o.csv.Error(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if o.file != nil {
+		if err := o.file.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func analyzeThroughput(s *statistics, out *analyzeOut) {
 	if s.Samples == nil {
 		log.Fatal("No samples found")
 	}
-	fmt.Println("Time Throughput")
+	out.row("Time", "Throughput")
 	last := s.Samples[0]
 	for _, samp := range s.Samples[1:] {
 		i := samp.Time - last.Time
 		// The sample-time is the middle of the interval
 		t := last.Time + i/2
 		// Throughput is the received/interval in KB/S
-		reckb := (samp.Received - last.Received) * s.PacketSize / 1024
+		reckb := s.receivedKB(last, samp)
+		out.row(t.Seconds(), reckb/i.Seconds())
 		last = samp
-		fmt.Println(t.Seconds(), float64(reckb)/i.Seconds())
+	}
+}
+
+// analyzeThroughputWindow prints the throughput and a moving average
+// over the last "window" seconds
+func analyzeThroughputWindow(s *statistics, out *analyzeOut, window int) {
+	if len(s.Samples) < 2 {
+		log.Fatal("No samples found")
+	}
+	if window < 1 {
+		window = 1
+	}
+	w := time.Duration(window) * time.Second
+	var times []time.Duration
+	var tputs []float64
+	out.row("Time", "Throughput", "Smoothed")
+	last := s.Samples[0]
+	first := 0
+	var sum float64
+	for _, samp := range s.Samples[1:] {
+		i := samp.Time - last.Time
+		t := last.Time + i/2
+		tput := s.receivedKB(last, samp) / i.Seconds()
 		last = samp
+
+		times = append(times, t)
+		tputs = append(tputs, tput)
+		sum += tput
+		for t-times[first] >= w {
+			sum -= tputs[first]
+			first++
+		}
+		out.row(t.Seconds(), tput, sum/float64(len(tputs)-first))
+	}
+}
+
+func analyzeConnThroughput(s *statistics, out *analyzeOut) {
+	out.row("Conn", "Time", "Throughput")
+	found := false
+	for n, c := range s.ConnStats {
+		if len(c.Samples) < 2 {
+			continue
+		}
+		found = true
+		last := c.Samples[0]
+		for _, samp := range c.Samples[1:] {
+			i := samp.Time - last.Time
+			t := last.Time + i/2
+			out.row(n, t.Seconds(), s.receivedKB(last, samp)/i.Seconds())
+			last = samp
+		}
+	}
+	if !found {
+		log.Fatal("No connection samples found")
 	}
 }
 
-func analyzeConnections(s *statistics) {
-	fmt.Println("Time Active New Failed Connecting")
+func analyzeConnections(s *statistics, out *analyzeOut) {
+	out.row("Time", "Active", "New", "Failed", "Connecting")
 	last := time.Duration(0)
 	for i := time.Second; i < s.Duration; i += time.Second {
 		var act, fail, connecting, new int
@@ -259,10 +872,192 @@ func analyzeConnections(s *statistics) {
 
 		}
 		imid := last + 500*time.Millisecond
-		fmt.Println(imid.Seconds(), act, new, fail, connecting)
+		out.row(imid.Seconds(), act, new, fail, connecting)
+		last = i
+	}
+}
+
+// analyzeFailRate prints the percentage of the connections active in
+// each second that ended with an error in that second
+func analyzeFailRate(s *statistics, out *analyzeOut) {
+	if len(s.ConnStats) == 0 {
+		log.Fatal("No connection statistics found")
+	}
+	out.row("Time", "FailurePct")
+	last := time.Duration(0)
+	for i := time.Second; i < s.Duration; i += time.Second {
+		var act, fail int
+		for _, c := range s.ConnStats {
+			if c.Started >= i || c.Ended < last {
+				continue // Not active in this interval
+			}
+			act++
+			if c.Err != "" && c.Ended < i {
+				fail++
+			}
+		}
+		pct := 0.0
+		if act > 0 {
+			pct = float64(fail) * 100 / float64(act)
+		}
+		imid := last + 500*time.Millisecond
+		out.row(imid.Seconds(), pct)
 		last = i
 	}
 }
+
+// hostRtt returns the mean RTT per server host
+func hostRtt(s *statistics) map[string]time.Duration {
+	sum := make(map[string]time.Duration)
+	n := make(map[string]time.Duration)
+	for _, c := range s.ConnStats {
+		if c.Host != "" && c.RTT > 0 {
+			sum[c.Host] += c.RTT
+			n[c.Host]++
+		}
+	}
+	for h := range sum {
+		sum[h] /= n[h]
+	}
+	return sum
+}
+
+// analyzeHostRttDiff compares the mean RTT per host in two statistics
+// files. Sorted by the absolute change with hosts in only one file last.
+func analyzeHostRttDiff(a, b *statistics, out *analyzeOut) {
+	rttA, rttB := hostRtt(a), hostRtt(b)
+	if len(rttA) == 0 && len(rttB) == 0 {
+		log.Fatal("No host RTT found")
+	}
+	type hostDiff struct {
+		host string
+		a, b time.Duration
+	}
+	var both, only []hostDiff
+	for h, ra := range rttA {
+		if rb, ok := rttB[h]; ok {
+			both = append(both, hostDiff{h, ra, rb})
+		} else {
+			only = append(only, hostDiff{h, ra, 0})
+		}
+	}
+	for h, rb := range rttB {
+		if _, ok := rttA[h]; !ok {
+			only = append(only, hostDiff{h, 0, rb})
+		}
+	}
+	abs := func(d time.Duration) time.Duration {
+		if d < 0 {
+			return -d
+		}
+		return d
+	}
+	sort.Slice(both, func(i, j int) bool {
+		di, dj := abs(both[i].b-both[i].a), abs(both[j].b-both[j].a)
+		if di != dj {
+			return di > dj
+		}
+		return both[i].host < both[j].host
+	})
+	sort.Slice(only, func(i, j int) bool { return only[i].host < only[j].host })
+
+	out.row("Host", "RttA", "RttB", "Change")
+	for _, d := range both {
+		out.row(d.host, d.a.Round(time.Microsecond), d.b.Round(time.Microsecond),
+			fmt.Sprintf("%+.1f%%", float64(d.b-d.a)*100/float64(d.a)))
+	}
+	for _, d := range only {
+		switch {
+		case d.b == 0:
+			out.row(d.host, d.a.Round(time.Microsecond), "-", "only-in-A")
+		default:
+			out.row(d.host, "-", d.b.Round(time.Microsecond), "only-in-B")
+		}
+	}
+}
+
+// analyzeRetransCorr prints the Pearson correlation between the
+// retransmits of the connections and if they failed
+func analyzeRetransCorr(s *statistics) {
+	var n, sx, sy, sxx, syy, sxy float64
+	for _, c := range s.ConnStats {
+		if c.Connect == 0 {
+			continue // Never connected
+		}
+		x := float64(c.Retransmits)
+		y := 0.0
+		if c.Err != "" {
+			y = 1
+		}
+		n++
+		sx += x
+		sy += y
+		sxx += x * x
+		syy += y * y
+		sxy += x * y
+	}
+	fmt.Printf("Connections: %.0f\n", n)
+	d := math.Sqrt(n*sxx-sx*sx) * math.Sqrt(n*syy-sy*sy)
+	if d == 0 {
+		fmt.Println("Correlation: undefined (no variation)")
+		return
+	}
+	r := (n*sxy - sx*sy) / d
+	fmt.Printf("Correlation: %.3f\n", r)
+	if r > 0.7 {
+		fmt.Println("WARNING: Connections with retransmits are likely to fail")
+	}
+}
+
+// analyzeStartDist prints histograms of the connection start times and
+// the times to connect in 100ms buckets
+func analyzeStartDist(s *statistics) {
+	const bucket = 100 * time.Millisecond
+	var starts, connects []int
+	add := func(h []int, d time.Duration) []int {
+		i := int(d / bucket)
+		for len(h) <= i {
+			h = append(h, 0)
+		}
+		h[i]++
+		return h
+	}
+	for _, c := range s.ConnStats {
+		starts = add(starts, c.Started)
+		if c.Connect != 0 {
+			connects = add(connects, c.Connect-c.Started)
+		}
+	}
+	if len(starts) == 0 {
+		log.Fatal("No connection statistics found")
+	}
+	fmt.Println("Start time (s):")
+	printHistogram(starts, bucket)
+	fmt.Println("Time to connect (s):")
+	printHistogram(connects, bucket)
+}
+
+// printHistogram prints buckets from the first non-empty one with bars
+// scaled to max 50 characters
+func printHistogram(h []int, bucket time.Duration) {
+	max, first := 0, -1
+	for i, n := range h {
+		if n > max {
+			max = n
+		}
+		if n > 0 && first < 0 {
+			first = i
+		}
+	}
+	if first < 0 {
+		return
+	}
+	for i := first; i < len(h); i++ {
+		fmt.Printf("%6.1f %5d %s\n", (time.Duration(i) * bucket).Seconds(), h[i],
+			strings.Repeat("#", (h[i]*50+max-1)/max))
+	}
+}
+
 func analyzeHosts(s *statistics) {
 	lost := make(map[string]int)
 	last := make(map[string]int)
@@ -283,32 +1078,278 @@ func analyzeHosts(s *statistics) {
 	fmt.Printf("Lasting connections: %d\n", nLast)
 	printKv(last)
 }
-func printKv(m map[string]int) {
-	keys := make([]string, 0)
-	for k := range m {
-		keys = append(keys, k)
+
+// analyzeAffinity groups the connections by server host. A source
+// address used towards more than one host indicates a routing anomaly,
+// since ECMP shall hash a flow to the same backend.
+func analyzeAffinity(s *statistics) {
+	count := make(map[string]int)
+	sources := make(map[string]map[string]bool)
+	hostsOf := make(map[string]map[string]bool)
+	for _, c := range s.ConnStats {
+		if c.Host == "" {
+			continue
+		}
+		count[c.Host]++
+		if sources[c.Host] == nil {
+			sources[c.Host] = make(map[string]bool)
+		}
+		src, _, err := net.SplitHostPort(c.Local)
+		if err != nil {
+			continue
+		}
+		sources[c.Host][src] = true
+		if hostsOf[src] == nil {
+			hostsOf[src] = make(map[string]bool)
+		}
+		hostsOf[src][c.Host] = true
 	}
-	sort.Strings(keys)
-	for _, key := range keys {
-		fmt.Printf("  %s %d\n", key, m[key])
+	if len(count) == 0 {
+		log.Fatal("No server hosts found")
+	}
+	hosts := make([]string, 0, len(count))
+	for h := range count {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	for _, h := range hosts {
+		srcs := make([]string, 0, len(sources[h]))
+		var overlap []string
+		for src := range sources[h] {
+			srcs = append(srcs, src)
+			if len(hostsOf[src]) > 1 {
+				overlap = append(overlap, src)
+			}
+		}
+		sort.Strings(srcs)
+		sort.Strings(overlap)
+		fmt.Printf("%s: %d connections\n", h, count[h])
+		fmt.Printf("  Sources: %s\n", strings.Join(srcs, " "))
+		if len(overlap) > 0 {
+			fmt.Printf("  Overlap: %s\n", strings.Join(overlap, " "))
+		}
 	}
 }
 
-// ----------------------------------------------------------------------
-// Client
-
-type ctConn interface {
-	Connect(ctx context.Context, address string) error
-	Run(ctx context.Context, s *statistics) error
+func analyzeEcn(s *statistics) {
+	var nConn, nEcn, nMarked int
+	var marks uint32
+	for _, c := range s.ConnStats {
+		if c.Connect == 0 {
+			continue
+		}
+		nConn++
+		if c.ECN {
+			nEcn++
+		}
+		if c.ECNMarksSeen > 0 {
+			nMarked++
+			marks += c.ECNMarksSeen
+		}
+	}
+	fmt.Printf("Connections: %d\n", nConn)
+	fmt.Printf("ECN negotiated: %d\n", nEcn)
+	fmt.Printf("Connections with CE marks: %d\n", nMarked)
+	fmt.Printf("CE marked packets: %d\n", marks)
 }
 
-// TODO: Use the "connstats" struct in the statistics section
-type connData struct {
-	id               uint32
+// analyzeGantt prints a chart with a row per connection and a column
+// per second. "=" is active, "." is connecting and "X" is failed.
+func analyzeGantt(s *statistics, limit int) {
+	if len(s.ConnStats) == 0 {
+		log.Fatal("No connection statistics found")
+	}
+	conns := s.ConnStats
+	if limit > 0 && len(conns) > limit {
+		conns = conns[:limit]
+	}
+	nSec := int((s.Duration + time.Second - 1) / time.Second)
+
+	var sb strings.Builder
+	sb.WriteString("Conn |")
+	for i := 0; i < nSec; i++ {
+		sb.WriteByte(byte('0' + i%10))
+	}
+	fmt.Println(sb.String())
+	for n, c := range conns {
+		sb.Reset()
+		fmt.Fprintf(&sb, "%4d |", n)
+		for i := 0; i < nSec; i++ {
+			t := time.Duration(i) * time.Second
+			switch {
+			case c.Started >= t+time.Second || c.Ended < t:
+				sb.WriteByte(' ') // Not started or ended
+			case c.Err != "" && c.Ended < t+time.Second:
+				sb.WriteByte('X')
+			case c.Connect == 0 || c.Connect >= t+time.Second:
+				sb.WriteByte('.')
+			default:
+				sb.WriteByte('=')
+			}
+		}
+		fmt.Println(strings.TrimRight(sb.String(), " "))
+	}
+}
+
+// analyzeTopFail prints the logical connections with the most connect
+// attempts. Attempts include re-connects and connect re-tries.
+func analyzeTopFail(s *statistics, out *analyzeOut, limit int) {
+	if len(s.ConnStats) == 0 {
+		log.Fatal("No connection statistics found")
+	}
+	type logicalConn struct {
+		conn     int
+		attempts uint32
+		time     time.Duration
+		errTypes map[string]bool
+		local    string
+		host     string
+	}
+	m := make(map[int]*logicalConn)
+	for _, c := range s.ConnStats {
+		lc, ok := m[c.Conn]
+		if !ok {
+			lc = &logicalConn{conn: c.Conn, errTypes: make(map[string]bool)}
+			m[c.Conn] = lc
+		}
+		lc.attempts += c.Retries + 1
+		lc.time += c.Ended - c.Started
+		if c.ErrType != "" {
+			lc.errTypes[c.ErrType] = true
+		}
+		if c.Local != "" {
+			lc.local = c.Local
+		}
+		if c.Host != "" {
+			lc.host = c.Host
+		}
+	}
+	conns := make([]*logicalConn, 0, len(m))
+	for _, lc := range m {
+		conns = append(conns, lc)
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		if conns[i].attempts != conns[j].attempts {
+			return conns[i].attempts > conns[j].attempts
+		}
+		return conns[i].conn < conns[j].conn
+	})
+	if limit > 0 && len(conns) > limit {
+		conns = conns[:limit]
+	}
+
+	out.row("Conn", "Attempts", "Time", "ErrTypes", "Local", "Host")
+	for _, lc := range conns {
+		errTypes := make([]string, 0, len(lc.errTypes))
+		for t := range lc.errTypes {
+			errTypes = append(errTypes, t)
+		}
+		sort.Strings(errTypes)
+		et := strings.Join(errTypes, ",")
+		if et == "" {
+			et = "-"
+		}
+		out.row(lc.conn, lc.attempts, lc.time.Seconds(), et, lc.local, lc.host)
+	}
+}
+
+// connMetric returns a function that computes the metric for a
+// connection. Throughput is in KB/s, rtt in ms and loss in percent of
+// the sent packets.
+func connMetric(s *statistics, metric string) func(c *connstats) float64 {
+	switch metric {
+	case "throughput":
+		return func(c *connstats) float64 {
+			if c.Connect == 0 || c.Ended <= c.Connect {
+				return 0
+			}
+			kb := float64(c.Received * s.PacketSize / 1024)
+			if c.ReceivedBytes > 0 {
+				kb = float64(c.ReceivedBytes) / 1024
+			}
+			return kb / (c.Ended - c.Connect).Seconds()
+		}
+	case "rtt":
+		return func(c *connstats) float64 {
+			return float64(c.RTT) / float64(time.Millisecond)
+		}
+	case "retransmits":
+		return func(c *connstats) float64 {
+			return float64(c.Retransmits)
+		}
+	case "loss":
+		return func(c *connstats) float64 {
+			if c.Sent == 0 {
+				return 0
+			}
+			return float64(c.Sent-c.Received) * 100 / float64(c.Sent)
+		}
+	}
+	log.Fatal("Unsupported metric; ", metric)
+	return nil
+}
+
+// analyzeTopN prints the connections with the highest metric. The
+// percentile is the share of connections with a lower or equal value.
+func analyzeTopN(s *statistics, out *analyzeOut, n int, metric string) {
+	if len(s.ConnStats) == 0 {
+		log.Fatal("No connection statistics found")
+	}
+	f := connMetric(s, metric)
+	values := make([]float64, len(s.ConnStats))
+	order := make([]int, len(s.ConnStats))
+	for i := range s.ConnStats {
+		values[i] = f(&s.ConnStats[i])
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return values[order[i]] > values[order[j]]
+	})
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	if n > 0 && len(order) > n {
+		order = order[:n]
+	}
+
+	out.row("Rank", "Percentile", metric, "ConnStats")
+	for rank, i := range order {
+		le := sort.Search(len(sorted), func(k int) bool { return sorted[k] > values[i] })
+		js, err := json.Marshal(&s.ConnStats[i])
+		if err != nil {
+			log.Fatal(err)
+		}
+		out.row(rank+1, fmt.Sprintf("%.1f", float64(le)*100/float64(len(sorted))),
+			fmt.Sprintf("%.3f", values[i]), string(js))
+	}
+}
+
+func printKv(m map[string]int) {
+	keys := make([]string, 0)
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Printf("  %s %d\n", key, m[key])
+	}
+}
+
+// ----------------------------------------------------------------------
+// Client
+
+type ctConn interface {
+	Connect(ctx context.Context, address string) error
+	Run(ctx context.Context, s *statistics) error
+}
+
+// TODO: Use the "connstats" struct in the statistics section
+type connData struct {
+	id               uint32
 	psize            int
 	rate             float64
 	sent             uint32
 	nPacketsReceived uint32
+	nBytesReceived   uint64
 	nPacketsDropped  uint32
 	err              error
 	tcpinfo          *tcpinfo.TCPInfo
@@ -319,6 +1360,62 @@ type connData struct {
 	remote           string
 	localAddr        net.Addr
 	host             string
+	connSamples      bool
+	samples          []sample
+	tcpinfoInterval  time.Duration
+	tiMu             sync.Mutex // Protects tcpinfoHistory from the sampler
+	tcpinfoHistory   []tcpinfoSample
+	writeTimeouts    uint32
+	psizeMin         int
+	psizeMax         int
+	rttTarget        time.Duration
+	minPsize         int
+	maxPsize         int
+	ecn              bool
+	ecnNegotiated    bool
+	ecnMarks         uint32
+	halfClose        bool
+	halfCloseHang    bool
+	waitClose        bool
+	teardown         time.Duration
+	spoofedReplies   uint32
+	serverConnID     uint32
+	rtt              time.Duration
+	connectTimeout   time.Duration
+	idleTimeout      time.Duration
+	pktTimeout       time.Duration
+	rnd              *rand.Rand
+	maxSendBuffer    int
+	readBuffer       int
+	tsDeltas         []int64 // Micro-seconds, -pkt_timestamp
+	rttHist          rttHistogram
+	lossPct          float64
+	recvRate         float64
+	owd              bool
+	serverProcTime   time.Duration
+	owdSum           time.Duration
+	owdCount         uint32
+	rateAssigned     bool
+	conn             int    // The logical connection
+	retries          uint32 // Failed connect attempts
+	task             *clientTask
+	sendJitter       time.Duration
+	alwaysID         bool
+	hostChanges      uint32
+}
+
+// received counts a received packet
+func (cd *connData) received(s *statistics, bytes int) {
+	cd.nPacketsReceived++
+	cd.nBytesReceived += uint64(bytes)
+	s.received(1, bytes)
+}
+
+// setLimiter makes the rate limiter reachable for a reload
+func (cd *connData) setLimiter(lim *rate.Limiter) {
+	if cd.task != nil {
+		cd.task.lim.Store(lim)
+	}
 }
 
 var cData []connData
@@ -326,15 +1423,32 @@ var nConn uint32
 
 func (c *config) clientMain() int {
 
-	s := newStats(*c.timeout, *c.rate, *c.nconn, uint32(*c.psize))
-	rand.Seed(time.Now().UnixNano())
+	c.setCPUAffinity()
+	c.openNetns()
+	c.resolveDestinations()
+	c.rateFromPct()
+	s := c.clientStats()
+	c.runClient(s)
+	c.printStats(s)
+	if *c.pushGw != "" {
+		c.pushStats(s)
+	}
+	return c.checkThresholds(s)
+}
 
-	// The connection array may contain re-connects
-	cData = make([]connData, (*c.nconn)*(*c.retries))
+// runClient runs the TCP clients until the test ends
+func (c *config) runClient(s *statistics) {
+	randSeed = time.Now().UnixNano()
+	rand.Seed(randSeed)
+
+	// The connection array may contain re-connects, and connections
+	// added on reload up to -max_nconn
+	cData = make([]connData, (*c.maxNconn)*(*c.retries))
+	nConn = 0
 	deadline := time.Now().Add(*c.timeout)
 	ctx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
-	ctx, cancel = signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	ctx, cancel = c.notifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
 	if *c.srccidr != "" {
@@ -344,233 +1458,1830 @@ func (c *config) clientMain() int {
 			log.Fatal("Set source failed:", err)
 		}
 	} else if *c.srcfile != "" {
-		c.adrgen = readAddresses(*c.srcfile)
+		c.adrgen = c.readSources()
+	}
+	if *c.replay != "" {
+		c.player = readReplay(*c.replay, c.adrgen, s.Started, *c.nconn)
+		c.adrgen = c.player
+	}
+	if *c.replayFile != "" {
+		c.recorder = newReplayRecorder(c.adrgen, s.Started, *c.nconn)
+		c.adrgen = c.recorder
+	}
+	if *c.connLog != "" {
+		c.clog = newConnLogger(*c.connLog)
+		defer c.clog.close()
+	}
+	if *c.traceFile != "" {
+		defer startTrace(*c.traceFile)()
+	}
+
+	// Logical connections are served by a pool of goroutines. A
+	// connection occupies a goroutine until it ends, and the worker
+	// then takes the next queued connection, or re-connect. The pool
+	// has one goroutine per logical connection unless limited by
+	// -goroutines. The queue holds all logical connections, including
+	// the ones added on reload, so a re-queue never blocks.
+	nworkers := *c.maxNconn
+	if *c.goroutines > 0 && *c.goroutines < nworkers {
+		nworkers = *c.goroutines
+	}
+	checkOpenFiles(nworkers)
+	work := make(chan *clientTask, *c.maxNconn)
+	if *c.ecn && tcpEcnSysctl() != "1" {
+		log.Println("WARNING: ECN is not requested, net.ipv4.tcp_ecn must be 1")
 	}
 
 	var wg sync.WaitGroup
 	wg.Add(*c.nconn)
-	for i := 0; i < *c.nconn; i++ {
-		go c.client(ctx, &wg, s)
+	types := c.clientTypeOf(s)
+	rates := c.connRates()
+	tasks := make([]*clientTask, *c.nconn)
+	for i := range tasks {
+		tasks[i] = newClientTask(ctx, i, types[i], rates[i])
+		work <- tasks[i]
 	}
-
-	if *c.monitor {
-		go monitor(s)
+	if *c.cfgFile != "" {
+		c.reload = c.newReloader(ctx, s, &wg, work, tasks, types)
+		wg.Add(1)
+		go c.reload.run()
 	}
+	for i := 0; i < nworkers; i++ {
+		go c.clientWorker(work, &wg, s)
+	}
+
+	bgctx, bgcancel := context.WithCancel(ctx)
+	bg := c.background(bgctx, s)
 
 	wg.Wait()
+	close(work)
+	bgcancel()
+	bg.Wait()
+	s.timedOut = errors.Is(ctx.Err(), context.DeadlineExceeded)
 
-	c.printStats(s)
-	return 0
+	if c.recorder != nil {
+		c.recorder.save(*c.replayFile)
+	}
+	c.checkTimeWait(s)
 }
 
-func (c *config) printStats(s *statistics) {
-	if *c.stats != "none" {
-		c.copyStats(s)
-		s.reportStats()
+// notifyContext is signal.NotifyContext with signals from c.notify,
+// which tests may replace to send signals without signaling the
+// process
+func (c *config) notifyContext(
+	ctx context.Context, sig ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan os.Signal, 1)
+	c.notify(ch, sig...)
+	go func() {
+		select {
+		case <-ch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	// As for signal.NotifyContext the signals are handled until stop
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel()
 	}
 }
 
-func (c *config) copyStats(s *statistics) {
-	if *c.stats == "all" {
-		s.ConnStats = make([]connstats, nConn)
-		for i := 0; len(cData) > i && len(s.ConnStats) > i; i++ {
-			cs := &s.ConnStats[i]
-			cd := &cData[i]
-			cs.Started = cd.started.Sub(s.Started)
-			cs.Ended = cd.ended.Sub(s.Started)
-			if !cd.connected.IsZero() {
-				cs.Connect = cd.connected.Sub(s.Started)
-			}
-			if cd.err != nil {
-				cs.Err = cd.err.Error()
-			}
-			cs.Sent = cd.sent
-			cs.Received = cd.nPacketsReceived
-			cs.Dropped = cd.nPacketsDropped
-			if cd.tcpinfo != nil {
-				cs.Retransmits = cd.tcpinfo.Total_retrans
-				s.Retransmits += cd.tcpinfo.Total_retrans
-			}
-			cs.Local = cd.local
-			cs.Remote = cd.remote
-			cs.Host = cd.host
+// checkTimeWait counts the client sockets in TIME_WAIT. Many rapid
+// re-connects may exhaust the ephemeral ports.
+func (c *config) checkTimeWait(s *statistics) {
+	locals := make(map[string]bool)
+	for i := range cData[:nConn] {
+		if a, err := net.ResolveTCPAddr("tcp", cData[i].local); err == nil {
+			locals[a.String()] = true
 		}
-	} else {
-		var i uint32
-		for i = 0; uint32(len(cData)) > i; i++ {
-			cd := &cData[i]
-			if cd.tcpinfo != nil {
-				s.Retransmits += cd.tcpinfo.Total_retrans
-			}
+	}
+	if len(locals) == 0 {
+		return
+	}
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		n, err := countTimeWait(path, locals)
+		if err != nil {
+			debugf("TIME_WAIT; %v", err)
 		}
-		s.Samples = nil
+		s.TimeWaitCount += n
+	}
+	if *c.warnTW > 0 && s.TimeWaitCount > *c.warnTW {
+		log.Printf("WARNING: %d sockets in TIME_WAIT\n", s.TimeWaitCount)
 	}
 }
 
-func (c *config) client(ctx context.Context, wg *sync.WaitGroup, s *statistics) {
-	defer wg.Done()
-
-	for {
-
-		// Check that we have > 2sec until deadline
-		deadline, _ := ctx.Deadline()
-		if time.Until(deadline) < 2*time.Second {
-			return
-		}
-
-		// Initiate a new connection
-		id := atomic.AddUint32(&nConn, 1) - 1
-		if int(id) >= len(cData) {
-			c.printStats(s)
-			log.Fatal("Too many re-connects: ", id)
+// countTimeWait counts sockets in TIME_WAIT with a local address in
+// "locals" in a /proc/net/tcp file
+func countTimeWait(path string, locals map[string]bool) (int, error) {
+	const tcpTimeWait = "06"
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	var n int
+	scanner := bufio.NewScanner(file)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st ...
+		f := strings.Fields(scanner.Text())
+		if len(f) < 4 || f[3] != tcpTimeWait {
+			continue
 		}
-		cd := &cData[id]
-		cd.id = id
-		cd.started = time.Now()
-		cd.psize = *c.psize
-		cd.rate = *c.rate / float64(*c.nconn)
-		if c.adrgen != nil {
-			a := c.adrgen.GetIPStringIdx(id)
-			if a == "" {
-				log.Fatalln("Ran out of source addresses")
-			}
-			sadr := withPort(a)
-			if saddr, err := net.ResolveTCPAddr("tcp", sadr); err != nil {
-				log.Fatal(err)
-			} else {
-				cd.localAddr = saddr
-			}
+		if a := procNetAddr(f[1]); a != nil && locals[a.String()] {
+			n++
 		}
+	}
+	return n, scanner.Err()
+}
 
-		var conn ctConn
-		switch *c.ctype {
-		case "echo":
-			conn = newEchoConn(cd)
-		default:
-			log.Fatal("Unsupported client; ", *c.ctype)
-		}
+// procNetAddr parses an "ADDR:PORT" hex address from /proc/net/tcp.
+// The address is 32-bit words in host byte order (little-endian
+// assumed).
+func procNetAddr(s string) *net.TCPAddr {
+	hexip, hexport, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil
+	}
+	b, err := hex.DecodeString(hexip)
+	if err != nil || len(b)%4 != 0 {
+		return nil
+	}
+	port, err := strconv.ParseUint(hexport, 16, 16)
+	if err != nil {
+		return nil
+	}
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.LittleEndian.Uint32(b[i:]))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}
+}
 
-		// Connect with re-try and back-off
-		backoff := 100 * time.Millisecond
-		err := conn.Connect(ctx, *c.addr)
-		for err != nil {
-			time.Sleep(backoff)
-			if ctx.Err() != nil {
-				// Interrupt or timeout
-				cd.ended = s.Started.Add(s.Duration)
-				s.failedConnect(1)
-				return
-			}
-			if backoff < time.Second {
-				backoff += 100 * time.Millisecond
-			}
-			if time.Until(deadline) < 2*time.Second {
-				cd.ended = s.Started.Add(s.Duration)
-				return
-			}
-			s.failedConnect(1)
-			err = conn.Connect(ctx, *c.addr)
+// checkThresholds returns exit code 2 if any -fail_on_* threshold is
+// exceeded, otherwise 0
+func (c *config) checkThresholds(s *statistics) int {
+	rc := 0
+	if *c.failLoss >= 0 && s.Sent > 0 {
+		loss := float64(s.Sent-s.Received) * 100 / float64(s.Sent)
+		if loss > *c.failLoss {
+			log.Printf("FAIL: Packet loss %.2f%% > %.2f%%\n", loss, *c.failLoss)
+			rc = 2
 		}
-		cd.connected = time.Now()
-
-		cd.err = conn.Run(ctx, s)
-		if cd.err == nil {
-			// NOTE: The connection *will* stop prematurely if the
-			// next packet can't be sent before the dead-line. However
-			// the stasistics should show that the connection exists
-			// to the test end.
-			cd.ended = s.Started.Add(s.Duration)
-			return // OK return
+	}
+	if *c.failConns >= 0 && int(s.FailedConnections) > *c.failConns {
+		log.Printf("FAIL: Failed connections %d > %d\n", s.FailedConnections, *c.failConns)
+		rc = 2
+	}
+	if *c.failRetr >= 0 {
+		retrans := s.Retransmits
+		if *c.stats == "none" {
+			// Not collected by printStats()
+			for i := range cData {
+				if cData[i].tcpinfo != nil {
+					retrans += cData[i].tcpinfo.Total_retrans
+				}
+			}
 		}
-		cd.ended = time.Now()
-
-		s.failedConnection(1)
-		if !*c.reconnect {
-			break
+		if int(retrans) > *c.failRetr {
+			log.Printf("FAIL: Retransmits %d > %d\n", retrans, *c.failRetr)
+			rc = 2
 		}
 	}
+	return rc
+}
 
+func (c *config) printStats(s *statistics) {
+	if *c.stats != "none" {
+		c.copyStats(s)
+		s.reportStats()
+	}
 }
 
-func monitor(s *statistics) {
-	deadline := s.Started.Add(s.Duration - 1500*time.Millisecond)
-	for time.Now().Before(deadline) {
-		time.Sleep(time.Second)
-		var nAct, nConnecting uint
-		for _, cd := range cData[:nConn] {
-			if cd.err == nil {
-				if cd.connected.IsZero() {
-					nConnecting++
-				} else {
-					nAct++
-				}
-			}
+// copyStats collects the totals from the connections. The ConnStats
+// are not copied, with "-stats all" they are encoded straight from the
+// connection array, see encode().
+func (c *config) copyStats(s *statistics) {
+	n := int(nConn)
+	if len(cData) < n {
+		n = len(cData)
+	}
+	for i := range cData[:n] {
+		if cd := &cData[i]; cd.tcpinfo != nil {
+			s.Retransmits += cd.tcpinfo.Total_retrans
 		}
-		fmt.Fprintf(
-			os.Stderr,
-			"Conn act/fail/connecting: %d/%d/%d, Packets send/rec/dropped: %d/%d/%d\n",
-			nAct, s.FailedConnections, nConnecting, s.Sent, s.Received, s.Dropped)
+	}
+	s.DestStats = destStatistics()
+	if *c.stats == "all" {
+		s.conns = cData[:n]
+	} else {
+		s.Samples = nil
 	}
 }
 
-func newLimiter(ctx context.Context, r float64, psize int) *rate.Limiter {
-	// Allow some burstiness but drain the bucket from start
-	// Introduce some ramndomness to spread traffic
-	lim := rate.NewLimiter(rate.Limit(r*1024.0), psize*10)
-	if lim.WaitN(ctx, rand.Intn(psize)) != nil {
+// destStatistics returns statistics per destination (remote address)
+func destStatistics() map[string]destStats {
+	type acc struct {
+		destStats
+		rttSum time.Duration
+		nRtt   int
+	}
+	m := make(map[string]*acc)
+	for i := 0; len(cData) > i && int(nConn) > i; i++ {
+		cd := &cData[i]
+		if cd.remote == "" {
+			continue // Never connected
+		}
+		a, ok := m[cd.remote]
+		if !ok {
+			a = &acc{}
+			m[cd.remote] = a
+		}
+		a.Connections++
+		if cd.err != nil {
+			a.FailedConnections++
+		}
+		if cd.rtt > 0 {
+			a.rttSum += cd.rtt
+			a.nRtt++
+		}
+	}
+	if len(m) == 0 {
 		return nil
 	}
-	for lim.AllowN(time.Now(), psize) {
+	dm := make(map[string]destStats, len(m))
+	for k, a := range m {
+		if a.nRtt > 0 {
+			a.MeanRTT = a.rttSum / time.Duration(a.nRtt)
+		}
+		dm[k] = a.destStats
 	}
-	return lim
+	return dm
 }
 
-// ----------------------------------------------------------------------
-// Echo Connection
-
-type echoConn struct {
-	cd   *connData
-	conn net.Conn
+// copyConnStats may be called concurrently for different connections
+func copyConnStats(s *statistics, cs *connstats, cd *connData) {
+	cs.Started = cd.started.Sub(s.Started)
+	cs.Ended = cd.ended.Sub(s.Started)
+	if !cd.connected.IsZero() {
+		cs.Connect = cd.connected.Sub(s.Started)
+	}
+	if cd.err != nil {
+		cs.Err = cd.err.Error()
+		cs.ErrType = errType(cd.err)
+	}
+	cs.Sent = cd.sent
+	cs.Received = cd.nPacketsReceived
+	cs.ReceivedBytes = cd.nBytesReceived
+	cs.Dropped = cd.nPacketsDropped
+	if cd.tcpinfo != nil {
+		cs.Retransmits = cd.tcpinfo.Total_retrans
+	}
+	cs.Local = cd.local
+	cs.Remote = cd.remote
+	cs.Host = cd.host
+	cs.ServerConnID = cd.serverConnID
+	cs.RTT = cd.rtt
+	cs.Samples = cd.samples
+	cd.tiMu.Lock()
+	cs.TCPInfoHistory = append([]tcpinfoSample(nil), cd.tcpinfoHistory...)
+	cd.tiMu.Unlock()
+	cs.WriteTimeouts = cd.writeTimeouts
+	cs.HalfCloseHang = cd.halfCloseHang
+	cs.TeardownMs = uint32(cd.teardown / time.Millisecond)
+	if cd.owdCount > 0 {
+		cs.OWD = cd.owdSum / time.Duration(cd.owdCount)
+	}
+	if cd.rateAssigned {
+		cs.AssignedRateMBps = cd.rate / 1024
+	}
+	cs.Conn = cd.conn
+	cs.Retries = cd.retries
+	cs.HostChanges = cd.hostChanges
+	cs.SpoofedReplies = cd.spoofedReplies
+	cs.ECN = cd.ecnNegotiated
+	cs.ECNMarksSeen = cd.ecnMarks
+	cs.TimestampDeltaUs = cd.tsDeltas
+	cs.RTTHistogram = cd.rttHist
+	if cd.psizeMax > 0 {
+		cs.MinPsize = uint32(cd.minPsize)
+		cs.MaxPsize = uint32(cd.maxPsize)
+		cs.FinalPsize = uint32(cd.psize)
+	}
 }
 
-func newEchoConn(cd *connData) ctConn {
-	return &echoConn{
-		cd: cd,
-	}
+// clientTask is a logical connection. The task is re-queued to the
+// worker pool on re-connect.
+type clientTask struct {
+	index   int
+	ctype   string
+	rate    float64
+	conns   int
+	failed  bool // The last connection failed
+	server  int  // The active server with -server_failover
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped int32
+	lim     atomic.Pointer[rate.Limiter]
+	last    *connData // The latest connection
 }
 
-func (c *echoConn) Connect(ctx context.Context, address string) error {
-	var err error
+func newClientTask(
+	ctx context.Context, index int, ctype string, connRate float64) *clientTask {
+	t := &clientTask{index: index, ctype: ctype, rate: connRate}
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	return t
+}
 
-	d := net.Dialer{
-		LocalAddr: c.cd.localAddr,
-		Timeout:   1500 * time.Millisecond,
+// destination returns the server address for a logical connection.
+// With -server_failover the active server of the connection is used.
+func (c *config) destination(t *clientTask) string {
+	if *c.failover != "" {
+		return c.daddrs[t.server]
 	}
-	c.conn, err = d.DialContext(ctx, "tcp", address)
-	return err
+	return c.daddrs[t.index%len(c.daddrs)]
 }
 
-func (c *echoConn) Run(ctx context.Context, s *statistics) error {
-	defer c.conn.Close()
+// nextServer fails over a logical connection to the next server in
+// the -server_failover list, and cycles back after the last
+func (c *config) nextServer(t *clientTask, s *statistics) string {
+	if len(c.daddrs) > 1 {
+		t.server = (t.server + 1) % len(c.daddrs)
+		s.failedOver(1)
+	}
+	return c.daddrs[t.server]
+}
 
-	c.cd.local = c.conn.LocalAddr().String()
-	c.cd.remote = c.conn.RemoteAddr().String()
+// stop stops the logical connection before the test end
+func (t *clientTask) stop() {
+	atomic.StoreInt32(&t.stopped, 1)
+	t.cancel()
+}
 
-	lim := newLimiter(ctx, c.cd.rate, c.cd.psize)
-	if lim == nil {
-		return nil
+// endTime returns the end time for a connection that is interrupted
+func (t *clientTask) endTime(s *statistics) time.Time {
+	if atomic.LoadInt32(&t.stopped) != 0 {
+		return time.Now()
 	}
+	return s.end()
+}
 
-	p := make([]byte, c.cd.psize)
-	for {
-		if lim.WaitN(ctx, c.cd.psize) != nil {
-			break
-		}
+// limiter returns the rate limiter of the current connection
+func (t *clientTask) limiter() *rate.Limiter {
+	return t.lim.Load()
+}
 
-		if _, err := c.conn.Write(p); err != nil {
-			return err
+// setCPUAffinity binds all threads of the process to the "-cpu_affinity"
+// CPUs. Threads created later inherits the affinity.
+func (c *config) setCPUAffinity() {
+	if *c.cpuAff == "" {
+		return
+	}
+	var set unix.CPUSet
+	for _, s := range strings.Split(*c.cpuAff, ",") {
+		cpu, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || cpu < 0 {
+			log.Fatal("Invalid cpu_affinity; ", *c.cpuAff)
 		}
-		c.cd.sent++
+		set.Set(cpu)
+	}
+	if set.Count() > runtime.NumCPU() {
+		log.Printf("WARNING: %d CPUs requested but only %d available\n",
+			set.Count(), runtime.NumCPU())
+	}
+	// SchedSetaffinity() only affects one thread
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		if err := unix.SchedSetaffinity(tid, &set); err != nil {
+			log.Fatal("Set cpu_affinity failed:", err)
+		}
+	}
+}
+
+// checkOpenFiles fails fast if "nconn" connections can't be open at the
+// same time. Some headroom is needed for stdio, files, etc.
+func checkOpenFiles(nconn int) {
+	var rlim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim); err != nil {
+		log.Println("WARNING: Getrlimit;", err)
+		return
+	}
+	need := uint64(nconn) + 20
+	if rlim.Cur < need {
+		log.Fatalf("Open files limit %d is too low for %d connections, use \"ulimit -n %d\"",
+			rlim.Cur, nconn, need)
+	}
+}
+
+// clientNetns is the "-netns" network namespace, nil if not used
+var clientNetns *os.File
+
+// openNetns opens the "-netns" network namespace
+func (c *config) openNetns() {
+	if *c.netnsPath == "" {
+		return
+	}
+	path := *c.netnsPath
+	if !strings.Contains(path, "/") {
+		path = "/var/run/netns/" + path
+	}
+	var err error
+	if clientNetns, err = os.Open(path); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// inNetns calls fn with the current thread in the "-netns" namespace.
+// Sockets belongs to the namespace they are created in, so only the
+// socket creation must be done in the namespace. Clients that create
+// sockets in other goroutines, e.g. grpc, must call it in the dialer.
+func inNetns(fn func() error) error {
+	if clientNetns == nil {
+		return fn()
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	orig, err := os.Open("/proc/thread-self/ns/net")
+	if err != nil {
+		return err
+	}
+	defer orig.Close()
+	if err := unix.Setns(int(clientNetns.Fd()), unix.CLONE_NEWNET); err != nil {
+		return os.NewSyscallError("setns", err)
+	}
+	err = fn()
+	if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err != nil {
+		// The thread can't be used for other goroutines
+		log.Fatal("Restore netns failed:", err)
+	}
+	return err
+}
+
+// resolveDestinations sets the destinations from the "-address" list,
+// or the "-server_failover" list. A single address is not resolved
+// with "-prefer_family auto" so all addresses of a host are tried on
+// connect.
+func (c *config) resolveDestinations() {
+	list := *c.addr
+	if *c.failover != "" {
+		list = *c.failover
+	}
+	addrs := strings.Split(list, ",")
+	if len(addrs) == 1 && *c.family == "auto" {
+		c.daddrs = addrs
+		return
+	}
+	start := time.Now()
+	var err error
+	if c.daddrs, err = resolveAddresses(addrs, *c.family, *c.dnsTmo); err != nil {
+		log.Fatal(err)
+	}
+	if len(addrs) > 1 {
+		log.Printf("Resolved %d addresses in %v\n", len(c.daddrs), time.Since(start))
+	}
+}
+
+// rateFromPct sets "-rate" from "-rate_pct" and the speed of the
+// interface used for the first destination
+func (c *config) rateFromPct() {
+	if *c.ratePct == 0 {
+		return
+	}
+	var iface string
+	err := inNetns(func() error {
+		var err error
+		iface, err = routeInterface(c.daddrs[0])
+		return err
+	})
+	if err != nil {
+		log.Fatal("-rate_pct; ", err)
+	}
+	b, err := os.ReadFile("/sys/class/net/" + iface + "/speed")
+	var mbps int
+	if err == nil {
+		mbps, err = strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+	if err != nil || mbps <= 0 {
+		log.Fatalf("Can't read the speed of %s, use -rate", iface)
+	}
+	*c.rate = *c.ratePct / 100 * float64(mbps) * 1000000 / 8 / 1024
+	log.Printf("Interface %s speed %d Mbit/s, rate %.1f KB/s\n", iface, mbps, *c.rate)
+}
+
+// routeInterface returns the name of the interface for the route to
+// an address. A connected UDP socket gets the source address without
+// sending anything.
+func routeInterface(address string) (string, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(local) {
+				return iface.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no interface with address %s", local)
+}
+
+// addressFamily returns ipv4, ipv6 or mixed for the destinations
+func (c *config) addressFamily() string {
+	var family string
+	for _, a := range c.daddrs {
+		host, _, err := net.SplitHostPort(a)
+		if err != nil {
+			host = a
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		f := "ipv6"
+		if ip.To4() != nil {
+			f = "ipv4"
+		}
+		if family != "" && f != family {
+			return "mixed"
+		}
+		family = f
+	}
+	return family
+}
+
+// pickFamily returns the first address of the family. "auto" prefers
+// ipv6.
+func pickFamily(ips []net.IPAddr, family string) (net.IP, error) {
+	for _, ip := range ips {
+		switch family {
+		case "ipv4":
+			if ip.IP.To4() != nil {
+				return ip.IP, nil
+			}
+		case "ipv6", "auto":
+			if ip.IP.To4() == nil {
+				return ip.IP, nil
+			}
+		}
+	}
+	if family == "auto" && len(ips) > 0 {
+		return ips[0].IP, nil
+	}
+	return nil, fmt.Errorf("no %s address", family)
+}
+
+// resolveAddresses resolves host names in "host:port" addresses
+// concurrently. The port is optional. The first address of a host
+// in the preferred family is used and the order is kept. IP addresses
+// are not changed.
+func resolveAddresses(
+	addrs []string, family string, timeout time.Duration) ([]string, error) {
+	type result struct {
+		i    int
+		addr string
+		err  error
+	}
+	ch := make(chan result, len(addrs))
+	for i, a := range addrs {
+		go func(i int, a string) {
+			if isUnixAbstract(a) {
+				ch <- result{i: i, addr: a}
+				return
+			}
+			host, port, err := net.SplitHostPort(a)
+			if err != nil {
+				host, port = a, ""
+			}
+			if net.ParseIP(host) != nil {
+				ch <- result{i: i, addr: a}
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				ch <- result{i: i, err: err}
+				return
+			}
+			pip, err := pickFamily(ips, family)
+			if err != nil {
+				ch <- result{i: i, err: fmt.Errorf("%s; %w", host, err)}
+				return
+			}
+			ip := pip.String()
+			if port != "" {
+				ip = net.JoinHostPort(ip, port)
+			}
+			ch <- result{i: i, addr: ip}
+		}(i, strings.TrimSpace(a))
+	}
+	resolved := make([]string, len(addrs))
+	for range addrs {
+		r := <-ch
+		if r.err != nil {
+			return nil, r.err
+		}
+		resolved[r.i] = r.addr
+	}
+	return resolved, nil
+}
+
+// connRates returns the rate for each logical connection drawn from
+// "-rate_distribution", or -rate/-nconn for all.
+func (c *config) connRates() []float64 {
+	rates := make([]float64, *c.nconn)
+	mean := *c.rate / float64(*c.nconn)
+	dist, params, _ := strings.Cut(*c.rateDist, ":")
+	var p []float64
+	for _, v := range strings.Split(params, ",") {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			p = append(p, f)
+		}
+	}
+	var sum float64
+	for i := range rates {
+		switch {
+		case dist == "":
+			rates[i] = mean
+		case dist == "uniform" && len(p) == 2 && p[1] >= p[0]:
+			rates[i] = p[0] + rand.Float64()*(p[1]-p[0])
+		case dist == "pareto" && len(p) == 1 && p[0] > 1:
+			// Heavy-tailed with the same mean as -rate/-nconn
+			xm := mean * (p[0] - 1) / p[0]
+			rates[i] = xm / math.Pow(1-rand.Float64(), 1/p[0])
+		default:
+			log.Fatal("Invalid rate_distribution; ", *c.rateDist)
+		}
+		sum += rates[i]
+	}
+	if sum > *c.rate*1.001 {
+		log.Printf("WARNING: Offered load %.1f KB/s exceeds -rate %.1f\n", sum, *c.rate)
+	}
+	return rates
+}
+
+// clientTypes are the supported "-client" types
+var clientTypes = map[string]func(cd *connData) ctConn{
+	"echo": newEchoConn,
+	"ping": newPingConn,
+	"grpc": newGrpcConn,
+}
+
+// clientTypeOf returns the client type for each logical connection.
+// The "-client_mix" spec, e.g. "echo:70%,ping:30%", overrides "-client".
+func (c *config) clientTypeOf(s *statistics) []string {
+	types := make([]string, *c.nconn)
+	if *c.clientMix == "" {
+		if _, ok := clientTypes[*c.ctype]; !ok {
+			log.Fatal("Unsupported client; ", *c.ctype)
+		}
+		for i := range types {
+			types[i] = *c.ctype
+		}
+		return types
+	}
+
+	s.ClientTypeCounts = make(map[string]int)
+	var first, pctSum int
+	for _, item := range strings.Split(*c.clientMix, ",") {
+		ctype, pct, ok := strings.Cut(strings.TrimSpace(item), ":")
+		if !ok {
+			log.Fatal("Invalid client mix; ", item)
+		}
+		if _, ok := clientTypes[ctype]; !ok {
+			log.Fatal("Unsupported client; ", ctype)
+		}
+		p, err := strconv.Atoi(strings.TrimSuffix(pct, "%"))
+		if err != nil || p < 0 {
+			log.Fatal("Invalid client mix; ", item)
+		}
+		pctSum += p
+		last := (pctSum*(*c.nconn) + 50) / 100
+		if last > *c.nconn {
+			last = *c.nconn
+		}
+		for i := first; i < last; i++ {
+			types[i] = ctype
+		}
+		s.ClientTypeCounts[ctype] += last - first
+		first = last
+	}
+	if pctSum != 100 {
+		log.Fatal("Client mix must add up to 100%; ", *c.clientMix)
+	}
+	return types
+}
+
+func (c *config) clientWorker(
+	work chan *clientTask, wg *sync.WaitGroup, s *statistics) {
+	for t := range work {
+		if c.client(t.ctx, t, s) {
+			work <- t
+		} else {
+			wg.Done()
+		}
+	}
+}
+
+// client makes one connection and runs traffic on it. Returns true if
+// the connection shall be re-connected.
+func (c *config) client(ctx context.Context, t *clientTask, s *statistics) bool {
+
+	if t.conns == 0 && *c.stagger > 0 {
+		// Spread the connection starts
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(*c.stagger * time.Duration(t.index)):
+		}
+	}
+	if t.failed && *c.retryDelay > 0 {
+		// A cool-down before re-connect
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(*c.retryDelay):
+		}
+	}
+	if !c.player.wait(ctx, t.index, t.conns) {
+		return false
+	}
+	t.conns++
+
+	// Check that we have > 2sec until deadline
+	deadline, _ := ctx.Deadline()
+	if time.Until(deadline) < 2*time.Second {
+		return false
+	}
+
+	// Initiate a new connection
+	cd := c.connSlot(s, t.last)
+	t.last = cd
+	id := cd.id
+	cd.started = time.Now()
+	cd.rnd = newConnRand(id)
+	ctx, task := trace.NewTask(ctx, "connection")
+	defer task.End()
+	cd.psize = *c.psize
+	cd.rate = t.rate * c.reload.rateFactor()
+	cd.rateAssigned = *c.rateDist != ""
+	cd.conn = t.index
+	cd.task = t
+	cd.sendJitter = *c.sendJitter
+	cd.alwaysID = *c.alwaysID
+	cd.connSamples = *c.cSamples
+	cd.tcpinfoInterval = *c.tiIval
+	cd.ecn = *c.ecn
+	cd.connectTimeout = *c.connTmo
+	cd.idleTimeout = *c.idleTmo
+	cd.pktTimeout = *c.pktTmo
+	cd.maxSendBuffer = *c.maxSndbuf
+	cd.readBuffer = *c.readBuf
+	cd.lossPct = *c.lossPct
+	cd.recvRate = *c.recvRate / float64(*c.nconn)
+	cd.owd = *c.owd
+	cd.serverProcTime = *c.srvProc
+	cd.halfClose = *c.halfClose
+	cd.waitClose = *c.waitClose
+	if *c.adaptive {
+		cd.psizeMin = *c.psizeMin
+		cd.psizeMax = *c.psizeMax
+		cd.rttTarget = *c.rttTarget
+		cd.minPsize = cd.psize
+		cd.maxPsize = cd.psize
+	}
+	if c.adrgen != nil {
+		// The replay recorder/player may be used without sources
+		if a := c.adrgen.GetIPStringIdx(id); a != "" {
+			if saddr, err := net.ResolveTCPAddr("tcp", withPort(a)); err != nil {
+				log.Fatal(err)
+			} else {
+				cd.localAddr = saddr
+			}
+		} else if *c.srccidr != "" || *c.srcfile != "" {
+			log.Fatalln("Ran out of source addresses")
+		}
+	}
+
+	var conn ctConn
+	switch {
+	case t.ctype == "echo" && *c.protocol == "dccp":
+		conn = newDccpConn(cd)
+	case t.ctype == "echo" && *c.protocol == "sctp":
+		conn = c.newSctpConn(cd)
+	default:
+		conn = clientTypes[t.ctype](cd)
+	}
+
+	// Connect with re-try and back-off
+	backoff := 100 * time.Millisecond
+	daddr := c.destination(t)
+	c.clog.event(cd, daddr, "started", nil)
+	connect := func() (err error) {
+		trace.WithRegion(ctx, "connect", func() {
+			err = inNetns(func() error { return conn.Connect(ctx, daddr) })
+		})
+		return err
+	}
+	err := connect()
+	for err != nil {
+		time.Sleep(backoff)
+		if ctx.Err() != nil {
+			// Interrupt or timeout
+			cd.ended = t.endTime(s)
+			s.failedConnect(1)
+			c.clog.event(cd, daddr, "failed", err)
+			return false
+		}
+		if backoff < time.Second {
+			backoff += 100 * time.Millisecond
+		}
+		if time.Until(deadline) < *c.connTmo+500*time.Millisecond {
+			cd.ended = s.end()
+			c.clog.event(cd, daddr, "failed", err)
+			return false
+		}
+		s.failedConnect(1)
+		cd.retries++
+		if !c.retryOnErr(err) {
+			cd.err = err
+			cd.ended = time.Now()
+			c.clog.event(cd, daddr, "failed", err)
+			return false
+		}
+		c.clog.event(cd, daddr, "reconnecting", err)
+		trace.Log(ctx, "reconnect", err.Error())
+		if *c.failover != "" {
+			daddr = c.nextServer(t, s)
+		}
+		err = connect()
+	}
+	cd.connected = time.Now()
+	c.clog.event(cd, daddr, "connected", nil)
+	if t.failed {
+		t.failed = false
+		s.successfulReconnect(uint32(t.conns - 1))
+	}
+
+	trace.WithRegion(ctx, "run", func() {
+		cd.err = conn.Run(ctx, s)
+	})
+	if cd.err != nil {
+		trace.Log(ctx, "close", cd.err.Error())
+	} else {
+		trace.Log(ctx, "close", "ok")
+	}
+	if cd.err == nil && *c.waitClose {
+		// The connection is torn down now
+		cd.ended = time.Now()
+		c.clog.event(cd, daddr, "ended", nil)
+		return false
+	}
+	if cd.err == nil {
+		// NOTE: The connection *will* stop prematurely if the
+		// next packet can't be sent before the dead-line. However
+		// the stasistics should show that the connection exists
+		// to the test end.
+		cd.ended = t.endTime(s)
+		c.clog.event(cd, daddr, "ended", nil)
+		return false // OK return
+	}
+	cd.ended = time.Now()
+	c.clog.event(cd, daddr, "failed", cd.err)
+
+	s.failedConnection(1)
+	t.failed = true
+	if *c.failover != "" {
+		c.nextServer(t, s)
+	}
+	return *c.reconnect && c.retryOnErr(cd.err)
+}
+
+// connSlot returns the connection data for a new connection. In
+// continuous mode a re-connect re-uses the slot of the previous
+// connection "prev" (nil for the first) so the connection array does
+// not run out. Only the last connection is then in the ConnStats.
+func (c *config) connSlot(s *statistics, prev *connData) *connData {
+	if prev != nil && s.continuous() {
+		*prev = connData{id: prev.id}
+		return prev
+	}
+	id := atomic.AddUint32(&nConn, 1) - 1
+	if int(id) >= len(cData) {
+		c.printStats(s)
+		log.Fatal("Too many re-connects: ", id)
+	}
+	cd := &cData[id]
+	cd.id = id
+	return cd
+}
+
+// startTrace starts a runtime trace. The returned function stops it.
+func startTrace(path string) func() {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := trace.Start(file); err != nil {
+		log.Fatal(err)
+	}
+	return func() {
+		trace.Stop()
+		if err := file.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// connLogger writes connection state transitions as JSON lines
+type connLogger struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+type connEvent struct {
+	ConnID    uint32    `json:"conn_id"`
+	Timestamp time.Time `json:"timestamp"`
+	State     string    `json:"state"`
+	Local     string    `json:"local,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func newConnLogger(path string) *connLogger {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &connLogger{file: file, enc: json.NewEncoder(file)}
+}
+
+// event logs a state transition. A nil logger is a no-op.
+func (l *connLogger) event(cd *connData, daddr, state string, err error) {
+	if l == nil {
+		return
+	}
+	e := connEvent{
+		ConnID:    cd.id,
+		Timestamp: time.Now(),
+		State:     state,
+		Local:     cd.local,
+		Remote:    cd.remote,
+	}
+	if e.Local == "" && cd.localAddr != nil {
+		e.Local = cd.localAddr.String()
+	}
+	if e.Remote == "" {
+		e.Remote = daddr
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(&e); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (l *connLogger) close() {
+	if err := l.file.Close(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// errType classifies an error as eof, reset, timeout, refused or other
+func errType(err error) string {
+	var nerr net.Error
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case err == errIdleTimeout || errors.As(err, &nerr) && nerr.Timeout():
+		return "timeout"
+	}
+	// Errors that are only available as text
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "connection reset"):
+		return "reset"
+	case strings.Contains(msg, "connection refused"):
+		return "refused"
+	case strings.Contains(msg, "timeout"):
+		return "timeout"
+	}
+	return "other"
+}
+
+// retryOnErr returns true if the error is in "-retry_on"
+func (c *config) retryOnErr(err error) bool {
+	t := errType(err)
+	for _, e := range strings.Split(*c.retryOn, ",") {
+		if e == "any" || e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// background starts the sampler and the monitor (if enabled). They
+// stop when the context is cancelled.
+func (c *config) background(ctx context.Context, s *statistics) *sync.WaitGroup {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.sample(ctx)
+	}()
+	if *c.monitor {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			monitor(ctx, s)
+		}()
+	}
+	if *c.deltaIval > 0 {
+		file, err := os.Create(*c.deltaFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			deltas(ctx, s, *c.deltaIval, file)
+		}()
+	}
+	return &wg
+}
+
+// delta is the increment of the counters since the last delta
+type delta struct {
+	Time              time.Duration
+	Sent              uint32
+	Received          uint32
+	Dropped           uint32
+	FailedConnections uint32
+}
+
+// deltas writes a delta each interval and a last one when the context
+// is cancelled, so the deltas add up to the totals
+func deltas(ctx context.Context, s *statistics, interval time.Duration, file *os.File) {
+	defer file.Close()
+	enc := json.NewEncoder(file)
+	var last delta
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case <-ticker.C:
+		}
+		cur := delta{
+			Time:              time.Since(s.Started),
+			Sent:              atomic.LoadUint32(&s.Sent),
+			Received:          atomic.LoadUint32(&s.Received),
+			Dropped:           atomic.LoadUint32(&s.Dropped),
+			FailedConnections: atomic.LoadUint32(&s.FailedConnections),
+		}
+		d := cur
+		d.Sent -= last.Sent
+		d.Received -= last.Received
+		d.Dropped -= last.Dropped
+		d.FailedConnections -= last.FailedConnections
+		if err := enc.Encode(&d); err != nil {
+			log.Fatal(err)
+		}
+		last = cur
+	}
+}
+
+func monitor(ctx context.Context, s *statistics) {
+	deadline := s.Started.Add(s.Duration - 1500*time.Millisecond)
+	for s.continuous() || time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+		var nAct, nConnecting uint
+		for i := range cData[:nConn] {
+			if cd := &cData[i]; cd.err == nil {
+				if cd.connected.IsZero() {
+					nConnecting++
+				} else {
+					nAct++
+				}
+			}
+		}
+		fmt.Fprintf(
+			os.Stderr,
+			"Conn act/fail/connecting: %d/%d/%d, Packets send/rec/dropped: %d/%d/%d\n",
+			nAct, atomic.LoadUint32(&s.FailedConnections), nConnecting,
+			atomic.LoadUint32(&s.Sent), atomic.LoadUint32(&s.Received),
+			atomic.LoadUint32(&s.Dropped))
+	}
+}
+
+// burstSize is the limiter burst in bytes, 0 means 10 packets
+var burstSize int
+
+// rateStart is the initial limiter bucket, see "-rate_start"
+var rateStart = "full"
+
+// randSeed is the base for the random sources of the connections. A
+// connection has its own source seeded with randSeed + id.
+var randSeed int64
+
+func newConnRand(id uint32) *rand.Rand {
+	return rand.New(rand.NewSource(randSeed + int64(id)))
+}
+
+// newLimiter returns nil if the context is done. A zero rate sends
+// nothing so the connection is idle until the test ends. The random
+// source is owned by the connection.
+func newLimiter(ctx context.Context, rnd *rand.Rand, r float64, psize int) *rate.Limiter {
+	if r <= 0 {
+		<-ctx.Done()
+		return nil
+	}
+	burst := limiterBurst(psize)
+	lim := rate.NewLimiter(rate.Limit(r*1024.0), burst)
+	switch rateStart {
+	case "empty":
+		// A new limiter has a full bucket, i.e. the burst is sent at start
+		return lim
+	case "random":
+		lim.AllowN(time.Now(), rnd.Intn(burst+1))
+		return lim
+	}
+	// Allow some burstiness but drain the bucket from start
+	// Introduce some ramndomness to spread traffic
+	if lim.WaitN(ctx, rnd.Intn(psize)) != nil {
+		return nil
+	}
+	for lim.AllowN(time.Now(), psize) {
+	}
+	return lim
+}
+
+// limiterBurst returns the limiter burst for the packet size
+func limiterBurst(psize int) int {
+	if burstSize > 0 {
+		// Must hold a packet
+		if burstSize < psize {
+			return psize
+		}
+		return burstSize
+	}
+	return psize * 10
+}
+
+// tokenWaiter waits for limiter tokens with a re-used timer.
+// Limiter.WaitN() allocates a new timer on every wait.
+type tokenWaiter struct {
+	lim   *rate.Limiter
+	timer *time.Timer
+}
+
+func newTokenWaiter(lim *rate.Limiter) *tokenWaiter {
+	t := time.NewTimer(time.Hour)
+	t.Stop()
+	return &tokenWaiter{lim: lim, timer: t}
+}
+
+// WaitN waits until "n" tokens are available or the context is done
+func (w *tokenWaiter) WaitN(ctx context.Context, n int) error {
+	now := time.Now()
+	r := w.lim.ReserveN(now, n)
+	if !r.OK() {
+		return fmt.Errorf("rate: Wait(n=%d) exceeds limiter's burst", n)
+	}
+	d := r.DelayFrom(now)
+	if d <= 0 {
+		return nil
+	}
+	w.timer.Reset(d)
+	select {
+	case <-ctx.Done():
+		r.Cancel()
+		if !w.timer.Stop() {
+			<-w.timer.C
+		}
+		return ctx.Err()
+	case <-w.timer.C:
+		return nil
+	}
+}
+
+// ----------------------------------------------------------------------
+// Echo Connection
+
+type echoConn struct {
+	cd   *connData
+	conn net.Conn
+}
+
+func newEchoConn(cd *connData) ctConn {
+	return &echoConn{
+		cd: cd,
+	}
+}
+
+func (c *echoConn) Connect(ctx context.Context, address string) error {
+	var err error
+
+	d := net.Dialer{
+		Timeout: c.cd.connectTimeout,
+	}
+	network, address := streamNetwork(address)
+	if network == "tcp" {
+		d.LocalAddr = c.cd.localAddr
+	}
+	c.conn, err = d.DialContext(ctx, network, address)
+	if err != nil {
+		return err
+	}
+	if tc, ok := c.conn.(*net.TCPConn); ok && c.cd.maxSendBuffer > 0 {
+		// Makes the limiter block when the network falls behind
+		// instead of filling a large kernel buffer
+		if err = tc.SetWriteBuffer(c.cd.maxSendBuffer); err != nil {
+			c.conn.Close()
+		}
+	}
+	return err
+}
+
+// lost returns true if a packet shall be dropped by -client_loss_pct
+func (c *echoConn) lost() bool {
+	return c.cd.lossPct > 0 && c.cd.rnd.Float64()*100 < c.cd.lossPct
+}
+
+func (c *echoConn) Run(ctx context.Context, s *statistics) error {
+	defer c.conn.Close()
+
+	c.cd.local = c.conn.LocalAddr().String()
+	c.cd.remote = c.conn.RemoteAddr().String()
+
+	if c.cd.tcpinfoInterval > 0 {
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go c.sampleTCPInfo(s, done, &wg)
+		defer wg.Wait()
+		defer close(done)
+	}
+
+	// With adaptive packet size the buffer must hold the max packet
+	// size. The limiter burst follows the packet size.
+	bufsize := c.cd.psize
+	if c.cd.psizeMax > bufsize {
+		bufsize = c.cd.psizeMax
+	}
+	if c.cd.rate <= 0 {
+		// Zero-packet mode. Only the connection and one probe packet
+		if err := c.probe(ctx, s); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		c.closing()
+		return nil
+	}
+	lim := newLimiter(ctx, c.cd.rnd, c.cd.rate, c.cd.psize)
+	if lim == nil {
+		return nil
+	}
+	c.cd.setLimiter(lim)
+	// A slow reader makes TCP back-pressure propagate to the server
+	var recvLim *rate.Limiter
+	if c.cd.recvRate > 0 {
+		if recvLim = newLimiter(ctx, c.cd.rnd, c.cd.recvRate, c.cd.psize); recvLim == nil {
+			return nil
+		}
+	}
+
+	// A read buffer larger than the packet reduces the read syscalls
+	// for large packets
+	var r io.Reader = c.conn
+	if c.cd.readBuffer > bufsize {
+		r = bufio.NewReaderSize(c.conn, c.cd.readBuffer)
+	}
+
+	var nextSample time.Time
+	lastSent := time.Now()
+	buf := make([]byte, bufsize)
+	waiter := newTokenWaiter(lim)
+	for {
+		p := buf[:c.cd.psize]
+		if c.cd.idleTimeout > 0 {
+			if err := c.waitIdle(ctx, lim, lastSent); err != nil {
+				if err == errIdleTimeout {
+					return err
+				}
+				break
+			}
+		} else if waiter.WaitN(ctx, c.cd.psize) != nil {
+			break
+		}
+
+		// The jitter delays the send, not the token wait
+		var jitter time.Duration
+		if c.cd.sendJitter > 0 {
+			var ok bool
+			if jitter, ok = sleepJitter(ctx, c.cd.rnd, c.cd.sendJitter); !ok {
+				break
+			}
+		}
+
+		if c.lost() {
+			// Simulated loss of the sent packet
+			c.cd.nPacketsDropped++
+			s.dropped(1)
+			lastSent = time.Now()
+			continue
+		}
+
+		if c.cd.owd {
+			binary.BigEndian.PutUint64(p, uint64(time.Now().UnixNano()))
+		}
+
+		// A full send buffer shall not stall the connection silently
+		if err := c.conn.SetWriteDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			return err
+		}
+		if _, err := c.conn.Write(p); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				c.cd.writeTimeouts++
+			}
+			return err
+		}
+		c.cd.sent++
+		s.sent(1)
+		lastSent = time.Now()
+		if c.cd.sent == 1 {
+			trace.Log(ctx, "packet", "first send")
+		}
+
+		// Read the clock once per packet. NOTE: setting SO_RCVTIMEO
+		// once instead of SetReadDeadline() per packet does not work
+		// since Go sockets are non-blocking and reads are handled by
+		// the runtime poller which ignores SO_RCVTIMEO. The deadline
+		// is a time.Time value and SetReadDeadline() does not allocate.
+		now := time.Now()
+		if jitter > 0 {
+			discardJitterTokens(lim, now, jitter, c.cd.psize)
+		}
+		for lim.AllowN(now, c.cd.psize) {
+			c.cd.nPacketsDropped++
+			s.dropped(1)
+		}
+
+		if err := c.conn.SetReadDeadline(now.Add(c.cd.pktTimeout)); err != nil {
+			return err
+		}
+		if c.cd.connSamples {
+			if now.After(nextSample) {
+				c.cd.samples = append(c.cd.samples, sample{
+					now.Sub(s.Started), c.cd.sent, c.cd.nPacketsReceived, c.cd.nPacketsDropped,
+					c.cd.nBytesReceived})
+				nextSample = now.Add(time.Second)
+			}
+		}
+		if recvLim != nil && recvLim.WaitN(ctx, len(p)) != nil {
+			break
+		}
+		if _, err := io.ReadFull(r, p); err != nil {
+			return err
+		}
+		if c.lost() {
+			// Simulated loss of the reply
+			c.cd.nPacketsDropped++
+			s.dropped(1)
+			continue
+		}
+		if c.cd.nPacketsReceived == 0 {
+			trace.Log(ctx, "packet", "first receive")
+			// First received packet _may_ contain a hostname and a
+			// server connection id
+			if n := bytes.IndexByte(p, 0); n > 0 {
+				c.cd.host = string(p[:n])
+				if n+5 <= len(p) {
+					c.cd.serverConnID = binary.BigEndian.Uint32(p[n+1:])
+				}
+			}
+		} else if c.cd.owd {
+			c.oneWayDelay(p)
+		} else if c.cd.alwaysID {
+			// The server may change, e.g. by a load-balancer
+			if n := bytes.IndexByte(p, 0); n > 0 && string(p[:n]) != c.cd.host {
+				debugf("Conn %d: host %s -> %s", c.cd.id, c.cd.host, p[:n])
+				c.cd.host = string(p[:n])
+				c.cd.hostChanges++
+			}
+		}
+
+		c.cd.received(s, len(p))
+
+		if c.cd.psizeMax > 0 && c.cd.nPacketsReceived%100 == 0 {
+			if c.adaptPsize() {
+				lim.SetBurst(limiterBurst(c.cd.psize))
+				if recvLim != nil {
+					recvLim.SetBurst(limiterBurst(c.cd.psize))
+				}
+			}
+		}
+	}
+
+	c.closing()
+	if c.cd.tcpinfo != nil {
+		c.cd.rtt = time.Duration(c.cd.tcpinfo.Rtt) * time.Microsecond
+	}
+	return nil
+}
+
+// probe sends one packet and measures the RTT of the echo
+func (c *echoConn) probe(ctx context.Context, s *statistics) error {
+	p := make([]byte, c.cd.psize)
+	if err := c.conn.SetDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		return err
+	}
+	sent := time.Now()
+	if _, err := c.conn.Write(p); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.cd.writeTimeouts++
+		}
+		return err
+	}
+	c.cd.sent++
+	s.sent(1)
+	if _, err := io.ReadFull(c.conn, p); err != nil {
+		return err
+	}
+	c.cd.rtt = time.Since(sent)
+	trace.Log(ctx, "packet", "probe")
+	if n := bytes.IndexByte(p, 0); n > 0 {
+		c.cd.host = string(p[:n])
+		if n+5 <= len(p) {
+			c.cd.serverConnID = binary.BigEndian.Uint32(p[n+1:])
+		}
+	}
+	c.cd.received(s, len(p))
+	return c.conn.SetDeadline(time.Time{})
+}
+
+// closing does the connection teardown and reads the final TCP info
+func (c *echoConn) closing() {
+	if c.cd.halfClose {
+		// Detect middleboxes that swallow the FIN
+		t, err := closeWrite(c.conn, 2*time.Second)
+		if err != nil {
+			debugf("Conn %d: half-close; %v", c.cd.id, err)
+			c.cd.halfCloseHang = true
+		}
+		c.cd.teardown = t
+	} else if c.cd.waitClose {
+		var err error
+		if c.cd.teardown, err = closeWrite(c.conn, 500*time.Millisecond); err != nil {
+			debugf("Conn %d: wait-close; %v", c.cd.id, err)
+		}
+	}
+
+	c.cd.tcpinfo, _ = getTCPInfo(c.conn)
+	if c.cd.ecn {
+		if ti, err := getTCPInfoExt(c.conn); err == nil {
+			c.cd.ecnNegotiated = ti.Options&tcpiOptEcn != 0
+			c.cd.ecnMarks = ti.DeliveredCE
+		}
+	}
+}
+
+var errIdleTimeout = errors.New("idle timeout")
+
+// sleepJitter sleeps a random time in [0, d] and returns it. Returns
+// false if the context is done.
+func sleepJitter(ctx context.Context, rnd *rand.Rand, d time.Duration) (time.Duration, bool) {
+	jitter := time.Duration(rnd.Int63n(int64(d) + 1))
+	t := time.NewTimer(jitter)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return jitter, false
+	case <-t.C:
+		return jitter, true
+	}
+}
+
+// discardJitterTokens discards the tokens that accumulated during a
+// jitter sleep, so they are not counted as dropped. The packets are
+// rounded up since the write time adds to a fraction of a packet. A
+// jitter shorter than the packet interval seldom leaves a whole packet
+// and the average rate is kept.
+func discardJitterTokens(lim *rate.Limiter, now time.Time, jitter time.Duration, psize int) {
+	n := int(math.Ceil(jitter.Seconds() * float64(lim.Limit()) / float64(psize)))
+	for ; n > 0 && lim.AllowN(now, psize); n-- {
+	}
+}
+
+// waitIdle waits for the limiter but returns errIdleTimeout if the next
+// packet can't be sent within the idle timeout.
+func (c *echoConn) waitIdle(
+	ctx context.Context, lim *rate.Limiter, lastSent time.Time) error {
+	idleDeadline := lastSent.Add(c.cd.idleTimeout)
+	wctx, cancel := context.WithDeadline(ctx, idleDeadline)
+	defer cancel()
+	err := lim.WaitN(wctx, c.cd.psize)
+	if err != nil && ctx.Err() == nil {
+		if deadline, ok := ctx.Deadline(); !ok || idleDeadline.Before(deadline) {
+			return errIdleTimeout
+		}
+	}
+	return err
+}
+
+// closeWrite sends a FIN and reads until EOF or timeout. The time
+// until EOF is returned.
+func closeWrite(conn net.Conn, timeout time.Duration) (time.Duration, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, errors.New("not a TCPConn")
+	}
+	start := time.Now()
+	if err := tc.CloseWrite(); err != nil {
+		return 0, err
+	}
+	if err := tc.SetReadDeadline(start.Add(timeout)); err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(io.Discard, tc); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// oneWayDelay takes the timestamp from an echoed packet. Client and
+// server clocks are not synchronized so the one-way delay is estimated
+// as half the round-trip without the server processing time.
+func (c *echoConn) oneWayDelay(p []byte) {
+	ts := int64(binary.BigEndian.Uint64(p))
+	d := time.Duration(time.Now().UnixNano()-ts) - c.cd.serverProcTime
+	if ts <= 0 || d < 0 {
+		return // E.g. overwritten by the server
+	}
+	c.cd.owdSum += d / 2
+	c.cd.owdCount++
+}
+
+// adaptPsize adjusts the packet size to fill the bandwidth-delay
+// product. The size is increased while the RTT is below target and
+// decreased when it is above. Returns true if the size is changed.
+func (c *echoConn) adaptPsize() bool {
+	ti, err := getTCPInfo(c.conn)
+	if err != nil {
+		return false
+	}
+	rtt := time.Duration(ti.Rtt) * time.Microsecond
+	psize := c.cd.psize
+	if rtt < c.cd.rttTarget {
+		psize += psize / 4
+	} else if rtt > c.cd.rttTarget {
+		psize -= psize / 4
+	}
+	if psize > c.cd.psizeMax {
+		psize = c.cd.psizeMax
+	}
+	if psize < c.cd.psizeMin {
+		psize = c.cd.psizeMin
+	}
+	if psize == c.cd.psize {
+		return false
+	}
+	debugf("Conn %d: rtt %v, psize %d -> %d", c.cd.id, rtt, c.cd.psize, psize)
+	c.cd.psize = psize
+	if psize < c.cd.minPsize {
+		c.cd.minPsize = psize
+	}
+	if psize > c.cd.maxPsize {
+		c.cd.maxPsize = psize
+	}
+	return true
+}
+
+// sampleTCPInfo collects TCP info periodically until "done" is closed
+func (c *echoConn) sampleTCPInfo(
+	s *statistics, done chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	ticker := time.NewTicker(c.cd.tcpinfoInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			ti, err := getTCPInfo(c.conn)
+			if err != nil {
+				continue
+			}
+			c.cd.tiMu.Lock()
+			c.cd.tcpinfoHistory = append(c.cd.tcpinfoHistory, tcpinfoSample{
+				Time:        now.Sub(s.Started),
+				Rtt:         ti.Rtt,
+				Cwnd:        ti.Snd_cwnd,
+				Retransmits: ti.Total_retrans,
+			})
+			c.cd.tiMu.Unlock()
+		}
+	}
+}
+
+// getTCPInfo reads TCP info for a connection. Unlike
+// tcpinfo.GetsockoptTCPInfo() the socket is not dup'ed, which matters
+// when TCP info is read often during a test.
+func getTCPInfo(conn net.Conn) (*tcpinfo.TCPInfo, error) {
+	var ti tcpinfo.TCPInfo
+	if err := getsockoptTCPInfo(conn, unsafe.Pointer(&ti), unsafe.Sizeof(ti)); err != nil {
+		return nil, err
+	}
+	return &ti, nil
+}
+
+// From linux/tcp.h
+const (
+	tcpiOptEcn     = 8
+	tcpiOptEcnSeen = 16
+)
+
+// tcpInfoExt is the Linux "struct tcp_info" up to tcpi_delivered_ce
+// which is not in syscall.TCPInfo. Fields not supported by the kernel
+// are left zero.
+type tcpInfoExt struct {
+	tcpinfo.TCPInfo
+	PacingRate    uint64
+	MaxPacingRate uint64
+	BytesAcked    uint64
+	BytesReceived uint64
+	SegsOut       uint32
+	SegsIn        uint32
+	NotsentBytes  uint32
+	MinRtt        uint32
+	DataSegsIn    uint32
+	DataSegsOut   uint32
+	DeliveryRate  uint64
+	BusyTime      uint64
+	RwndLimited   uint64
+	SndbufLimited uint64
+	Delivered     uint32
+	DeliveredCE   uint32
+}
+
+func getTCPInfoExt(conn net.Conn) (*tcpInfoExt, error) {
+	var ti tcpInfoExt
+	if err := getsockoptTCPInfo(conn, unsafe.Pointer(&ti), unsafe.Sizeof(ti)); err != nil {
+		return nil, err
+	}
+	return &ti, nil
+}
+
+func getsockoptTCPInfo(conn net.Conn, ti unsafe.Pointer, tisize uintptr) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return errors.New("not a TCPConn")
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		size := uint32(tisize)
+		_, _, e := syscall.Syscall6(
+			syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_INFO,
+			uintptr(ti), uintptr(unsafe.Pointer(&size)), 0)
+		if e != 0 {
+			serr = e
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// tcpEcnSysctl returns the value of net.ipv4.tcp_ecn. 1 means that
+// ECN is requested on outgoing connections, 2 (default) that ECN is
+// only accepted on incoming connections and 0 disabled. ECN for TCP
+// can't be enabled per socket.
+func tcpEcnSysctl() string {
+	b, err := os.ReadFile("/proc/sys/net/ipv4/tcp_ecn")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
+
+// ----------------------------------------------------------------------
+// Ping Connection
+
+// pingConn sends ICMP Echo Requests. No ctraffic server is needed but
+// raw sockets requires CAP_NET_RAW.
+type pingConn struct {
+	cd    *connData
+	conn  *icmp.PacketConn
+	proto int
+	dst   *net.IPAddr
+	id    int
+}
+
+func newPingConn(cd *connData) ctConn {
+	return &pingConn{
+		cd: cd,
+	}
+}
+
+func (c *pingConn) Connect(ctx context.Context, address string) error {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h // The port is ignored
+	}
+	var err error
+	if c.dst, err = net.ResolveIPAddr("ip", host); err != nil {
+		return err
+	}
+	network, laddr := "ip4:icmp", "0.0.0.0"
+	c.proto = 1 // ICMP
+	if c.dst.IP.To4() == nil {
+		network, laddr = "ip6:ipv6-icmp", "::"
+		c.proto = 58 // ICMPv6
+	}
+	if a, ok := c.cd.localAddr.(*net.TCPAddr); ok && a != nil {
+		laddr = a.IP.String()
+	}
+	// Raw sockets gets all replies so they are matched on id and seq
+	c.id = (os.Getpid() + int(c.cd.id)) & 0xffff
+	c.conn, err = icmp.ListenPacket(network, laddr)
+	return err
+}
+
+func (c *pingConn) Run(ctx context.Context, s *statistics) error {
+	defer c.conn.Close()
+
+	c.cd.local = c.conn.LocalAddr().String()
+	c.cd.remote = c.dst.String()
+
+	lim := newLimiter(ctx, c.cd.rnd, c.cd.rate, c.cd.psize)
+	if lim == nil {
+		return nil
+	}
+	c.cd.setLimiter(lim)
+
+	var typ icmp.Type = ipv4.ICMPTypeEcho
+	if c.proto == 58 {
+		typ = ipv6.ICMPTypeEchoRequest
+	}
+	// The packet size includes the 8 byte ICMP header
+	data := make([]byte, c.cd.psize-8)
+	buf := make([]byte, c.cd.psize+512)
+	var rttSum time.Duration
+	for seq := 0; ; seq = (seq + 1) & 0xffff {
+		if lim.WaitN(ctx, c.cd.psize) != nil {
+			break
+		}
+
+		msg := icmp.Message{
+			Type: typ,
+			Body: &icmp.Echo{ID: c.id, Seq: seq, Data: data},
+		}
+		wb, err := msg.Marshal(nil)
+		if err != nil {
+			return err
+		}
+		sent := time.Now()
+		if _, err := c.conn.WriteTo(wb, c.dst); err != nil {
+			return err
+		}
+		c.cd.sent++
 		s.sent(1)
 
 		for lim.AllowN(time.Now(), c.cd.psize) {
@@ -578,71 +3289,662 @@ func (c *echoConn) Run(ctx context.Context, s *statistics) error {
 			s.dropped(1)
 		}
 
-		if err := c.conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		if err := c.conn.SetReadDeadline(sent.Add(time.Second)); err != nil {
 			return err
 		}
-		if _, err := io.ReadFull(c.conn, p); err != nil {
-			return err
-		}
-		if c.cd.nPacketsReceived == 0 {
-			// First received packet _may_ contain a hostname
-			if n := bytes.IndexByte(p, 0); n > 0 {
-				c.cd.host = string(p[:n])
+		for {
+			n, _, err := c.conn.ReadFrom(buf)
+			if err != nil {
+				break // Probably a timeout, i.e. a lost packet
+			}
+			if c.isReply(buf[:n], seq) {
+				rtt := time.Since(sent)
+				rttSum += rtt
+				c.cd.rttHist.add(rtt)
+				c.cd.received(s, n)
+				break
 			}
 		}
-
-		c.cd.nPacketsReceived++
-		s.received(1)
 	}
 
-	c.cd.tcpinfo, _ = tcpinfo.GetsockoptTCPInfo(&c.conn)
+	if c.cd.nPacketsReceived > 0 {
+		c.cd.rtt = rttSum / time.Duration(c.cd.nPacketsReceived)
+	}
 	return nil
 }
 
+// rttHistogram counts RTTs in power of 2 micro-second buckets. Bucket
+// 0 is RTTs below 1us and bucket i is RTTs in [2^(i-1), 2^i) us.
+type rttHistogram []uint32
+
+func (h *rttHistogram) add(rtt time.Duration) {
+	i := bits.Len64(uint64(rtt / time.Microsecond))
+	for len(*h) <= i {
+		*h = append(*h, 0)
+	}
+	(*h)[i]++
+}
+
+// isReply returns true if the packet is the Echo Reply for seq
+func (c *pingConn) isReply(p []byte, seq int) bool {
+	m, err := icmp.ParseMessage(c.proto, p)
+	if err != nil {
+		return false
+	}
+	if m.Type != ipv4.ICMPTypeEchoReply && m.Type != ipv6.ICMPTypeEchoReply {
+		return false
+	}
+	e, ok := m.Body.(*icmp.Echo)
+	return ok && e.ID == c.id && e.Seq == seq
+}
+
 // ----------------------------------------------------------------------
 // Server
 
+// setBacklog changes the listen backlog. Go always uses
+// net.core.somaxconn, but on Linux listen() can be called again on a
+// listening socket to update the backlog.
+func setBacklog(l *net.TCPListener, backlog int) error {
+	rc, err := l.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var lerr error
+	if err := rc.Control(func(fd uintptr) {
+		lerr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+	return os.NewSyscallError("listen", lerr)
+}
+
 func (c *config) serverMain() int {
-	l, err := net.Listen("tcp", *c.addr)
+	started := time.Now()
+	defer c.printServerStats(started)
+	if *c.srvStats != "" {
+		defer c.saveServerClients(*c.srvStats)
+	}
+	l, err := net.Listen(streamNetwork(*c.addr))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer l.Close()
 	log.Println("Listen on address; ", *c.addr)
+	if tl, ok := l.(*net.TCPListener); ok && *c.backlog > 0 {
+		if err := setBacklog(tl, *c.backlog); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	deny := parseCidrs(*c.denyCidr)
+
+	if *c.serverEcn && tcpEcnSysctl() == "0" {
+		log.Println("WARNING: ECN is disabled, net.ipv4.tcp_ecn=0")
+	}
+
+	// On SIGINT/SIGTERM all connections are closed
+	ctx, cancel := signal.NotifyContext(
+		context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// On SIGUSR1 stop accepting new connections but let existing
+	// connections finish
+	var draining int32
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			log.Println("Shutdown, active connections; ", sconns.count())
+		case <-usr1:
+			log.Println("Draining, active connections; ", sconns.count())
+			atomic.StoreInt32(&draining, 1)
+		}
+		l.Close()
+	}()
+
+	// On SIGUSR2 print the statistics. Can be repeated
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-usr2:
+				c.printServerStats(started)
+				c.writeServerClients(os.Stderr)
+			}
+		}
+	}()
+
+	// The peak accept rate is always tracked
+	go acceptRateMonitor(ctx, *c.acceptLog)
+
+	// With -server_conn_rate new connections wait in the kernel backlog
+	var acceptLim *rate.Limiter
+	if *c.acceptRate > 0 {
+		acceptLim = rate.NewLimiter(rate.Limit(*c.acceptRate), 1)
+	}
 
 	for {
 		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				sconns.wg.Wait()
+				return 0
+			}
+			if atomic.LoadInt32(&draining) != 0 {
+				return c.drain(ctx)
+			}
+			log.Fatal(err)
+		}
+		atomic.AddUint32(&accepted, 1)
+		if denied(deny, conn) {
+			// Reset the connection
+			atomic.AddUint32(&deniedConns, 1)
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+			continue
+		}
+		if acceptLim != nil && !throttleAccept(ctx, acceptLim) {
+			conn.Close()
+			continue
+		}
+		sconns.add(conn)
+		go func() {
+			defer sconns.remove(conn)
+			c.server(ctx, conn)
+		}()
+	}
+}
+
+func parseCidrs(cidrs string) []*net.IPNet {
+	if cidrs == "" {
+		return nil
+	}
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(cidrs, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
 		if err != nil {
 			log.Fatal(err)
 		}
-		go server(conn)
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// denied returns true if the remote address is in a denied CIDR
+func denied(deny []*net.IPNet, conn net.Conn) bool {
+	a, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range deny {
+		if n.Contains(a.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+var deniedConns uint32
+
+// throttledAccepts counts connections that waited > 100ms for the
+// -server_conn_rate limiter
+var throttledAccepts uint32
+
+// throttleAccept waits for the accept rate limiter. Returns false if
+// the context is done.
+func throttleAccept(ctx context.Context, lim *rate.Limiter) bool {
+	start := time.Now()
+	if lim.Wait(ctx) != nil {
+		return false
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		atomic.AddUint32(&throttledAccepts, 1)
+	}
+	return true
+}
+
+// oversizedPkts counts UDP packets larger than -server_max_pkt
+var oversizedPkts uint32
+
+// accepted counts accepted connections for the accept rate
+var accepted uint32
+var peakAcceptRate uint32
+
+// acceptRateMonitor updates the peak accept rate every second, and
+// prints the rate if "logRate" is set
+func acceptRateMonitor(ctx context.Context, logRate bool) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n := atomic.SwapUint32(&accepted, 0)
+		if n > atomic.LoadUint32(&peakAcceptRate) {
+			atomic.StoreUint32(&peakAcceptRate, n)
+		}
+		if logRate {
+			fmt.Fprintf(os.Stderr, "Accepted conn/s: %d, active: %d\n", n, sconns.count())
+		}
+	}
+}
+
+// serverStats is printed on stdout on SIGUSR2 and at shutdown
+type serverStats struct {
+	Started           time.Time
+	Duration          time.Duration
+	CPUUserMs         uint64
+	CPUSystemMs       uint64
+	DeniedConnections uint32 `json:",omitempty"`
+	OversizedPackets  uint32 `json:",omitempty"`
+	ThrottledAccepts  uint32 `json:",omitempty"`
+
+	MeanServerProcessUs uint32 `json:",omitempty"`
+	MeanUDPProcessUs    uint32 `json:",omitempty"`
+	PeakAcceptRate      uint32 `json:",omitempty"`
+	ActiveUDPFlows      int    `json:",omitempty"`
+}
+
+func (c *config) printServerStats(started time.Time) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		log.Println("Getrusage; ", err)
+		return
+	}
+	s := serverStats{
+		Started:     started,
+		Duration:    time.Since(started),
+		CPUUserMs:   uint64(time.Duration(usage.Utime.Nano()) / time.Millisecond),
+		CPUSystemMs: uint64(time.Duration(usage.Stime.Nano()) / time.Millisecond),
+
+		DeniedConnections: atomic.LoadUint32(&deniedConns),
+		OversizedPackets:  atomic.LoadUint32(&oversizedPkts),
+		ThrottledAccepts:  atomic.LoadUint32(&throttledAccepts),
+
+		MeanServerProcessUs: serverProc.meanUs(),
+		MeanUDPProcessUs:    udpProc.meanUs(),
+		PeakAcceptRate:      atomic.LoadUint32(&peakAcceptRate),
+		ActiveUDPFlows:      udpFlows.activeSince(time.Now().Add(-*c.flowTmo)),
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(&s); err != nil {
+		log.Println(err)
+	}
+}
+
+// serverClient holds the statistics for a client connection, i.e. the
+// server side of a "connstats"
+type serverClient struct {
+	remote       string
+	connected    time.Time
+	disconnected atomic.Int64 // Unix nano-seconds
+	connID       atomic.Uint32
+	bytes        atomic.Uint64
+}
+
+// serverClientStats is the json form of a serverClient. "Packets" is
+// Bytes / -psize, so the clients must use the same -psize.
+type serverClientStats struct {
+	Remote       string
+	ConnID       uint32 `json:",omitempty"`
+	Connected    time.Time
+	Disconnected *time.Time `json:",omitempty"`
+	Packets      uint64
+	Bytes        uint64
+}
+
+// serverClients maps the remote address of a connected client to a
+// *serverClient. The address matches "connstats.Local" of the client.
+// On disconnect the client is moved to the closedClients, so a
+// re-used address does not replace an earlier client.
+var serverClients sync.Map
+
+// closedClients holds the latest disconnected clients, at most
+// -server_max_clients, so a long lived server does not grow
+var closedClients struct {
+	sync.Mutex
+	list []*serverClient
+}
+
+func newServerClient(conn net.Conn) *serverClient {
+	sc := &serverClient{remote: conn.RemoteAddr().String(), connected: time.Now()}
+	serverClients.Store(sc.remote, sc)
+	return sc
+}
+
+// disconnect moves the client to the closedClients. The oldest is
+// dropped if there are more than "max".
+func (sc *serverClient) disconnect(max int) {
+	sc.disconnected.Store(time.Now().UnixNano())
+	closedClients.Lock()
+	defer closedClients.Unlock()
+	// Under the lock so a snapshot sees the client in one place
+	serverClients.Delete(sc.remote)
+	if max == 0 {
+		return
+	}
+	if len(closedClients.list) >= max {
+		closedClients.list[0] = nil
+		closedClients.list = closedClients.list[1:]
+	}
+	closedClients.list = append(closedClients.list, sc)
+}
+
+// countWriter counts the bytes written
+type countWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (cw countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(uint64(n))
+	return n, err
+}
+
+// serverClientsSnapshot returns the connected and the kept
+// disconnected clients, ordered by connect time
+func serverClientsSnapshot(psize int) []serverClientStats {
+	closedClients.Lock()
+	clients := append([]*serverClient{}, closedClients.list...)
+	serverClients.Range(func(k, v interface{}) bool {
+		clients = append(clients, v.(*serverClient))
+		return true
+	})
+	closedClients.Unlock()
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].connected.Before(clients[j].connected)
+	})
+
+	l := make([]serverClientStats, len(clients))
+	for i, sc := range clients {
+		cs := &l[i]
+		cs.Remote = sc.remote
+		cs.ConnID = sc.connID.Load()
+		cs.Connected = sc.connected
+		cs.Bytes = sc.bytes.Load()
+		cs.Packets = cs.Bytes / uint64(psize)
+		if t := sc.disconnected.Load(); t != 0 {
+			d := time.Unix(0, t)
+			cs.Disconnected = &d
+		}
+	}
+	return l
+}
+
+func (c *config) writeServerClients(w io.Writer) {
+	if err := json.NewEncoder(w).Encode(serverClientsSnapshot(*c.psize)); err != nil {
+		log.Println(err)
+	}
+}
+
+func (c *config) saveServerClients(path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	defer file.Close()
+	c.writeServerClients(file)
+}
+
+// drain waits for server connections to end. Remaining connections
+// are closed after -drain_timeout.
+func (c *config) drain(ctx context.Context) int {
+	done := make(chan struct{})
+	go func() {
+		sconns.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Println("Drained")
+	case <-ctx.Done():
+		log.Println("Shutdown, active connections; ", sconns.count())
+		<-done
+	case <-time.After(*c.drainTmo):
+		log.Println("Drain timeout, closing connections; ", sconns.count())
+		sconns.closeAll()
+	}
+	return 0
+}
+
+// serverConns holds the active server connections
+type serverConns struct {
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+	conns map[net.Conn]struct{}
+}
+
+var sconns = serverConns{conns: make(map[net.Conn]struct{})}
+
+func (t *serverConns) add(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.wg.Add(1)
+	t.conns[conn] = struct{}{}
+}
+
+func (t *serverConns) remove(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, conn)
+	t.wg.Done()
+}
+
+func (t *serverConns) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns)
+}
+
+func (t *serverConns) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+var serverConnID uint32
+
+func (c *config) server(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	// Close the connection on shutdown. This interrupts blocked reads
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	sc := newServerClient(conn)
+	defer sc.disconnect(*c.maxClients)
+	w := countWriter{w: conn, n: &sc.bytes}
+
+	// Insert our hostname in the first packet followed by a null and
+	// a connection id if there is room
+	p := make([]byte, 64)
+	if _, err := io.ReadFull(conn, p); err != nil {
+		return
+	}
+	fill, _ := newPayloadFiller(*c.payload)
+	if fill != nil {
+		fill(p)
+	}
+	if host := serverHost(); host != "" {
+		n := copy(p[:], host)
+		if n+5 <= len(p) {
+			p[n] = 0
+			id := atomic.AddUint32(&serverConnID, 1)
+			binary.BigEndian.PutUint32(p[n+1:], id)
+			sc.connID.Store(id)
+		}
+	}
+	if _, err := w.Write(p); err != nil {
+		return
+	}
+
+	if *c.srvTiming || *c.alwaysID {
+		var id []byte
+		if *c.alwaysID {
+			id = append([]byte(serverHost()), 0)
+		}
+		framedEcho(conn, w, *c.psize, len(p), fill, id)
+	} else if fill == nil {
+		// Hide io.WriterTo since it would not use our buffer
+		io.CopyBuffer(w, struct{ io.Reader }{conn}, c.echoBuffer())
+	} else {
+		// Respond with the same amount of data as received
+		buf := c.echoBuffer()
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				fill(buf[:n])
+				if _, err := w.Write(buf[:n]); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	if *c.serverEcn {
+		if ti, err := getTCPInfo(conn); err == nil {
+			log.Printf(
+				"ECN %s; negotiated=%v, ect-seen=%v\n", conn.RemoteAddr(),
+				ti.Options&tcpiOptEcn != 0, ti.Options&tcpiOptEcnSeen != 0)
+		}
+	}
+}
+
+// echoBuffer returns a buffer for the TCP echo of at most -server_max_pkt
+func (c *config) echoBuffer() []byte {
+	if *c.srvMaxPkt < 32*1024 {
+		return make([]byte, *c.srvMaxPkt)
+	}
+	return make([]byte, 32*1024)
+}
+
+// framedEcho echoes packets of "psize" bytes and records the time from
+// the first byte of a packet is read until the echo is sent. "done"
+// bytes of the first packet are already echoed. If "id" is set it is
+// inserted in every packet.
+func framedEcho(conn io.Reader, w io.Writer, psize, done int, fill func(p []byte), id []byte) {
+	r := bufio.NewReaderSize(conn, psize)
+	p := make([]byte, psize)
+	if done < psize {
+		if _, err := io.ReadFull(r, p[done:]); err != nil {
+			return
+		}
+		if fill != nil {
+			fill(p[done:])
+		}
+		if _, err := w.Write(p[done:]); err != nil {
+			return
+		}
+	}
+	for {
+		if _, err := r.Peek(1); err != nil {
+			return
+		}
+		start := time.Now()
+		if _, err := io.ReadFull(r, p); err != nil {
+			return
+		}
+		if fill != nil {
+			fill(p)
+		}
+		copy(p, id)
+		if _, err := w.Write(p); err != nil {
+			return
+		}
+		serverProc.add(time.Since(start))
 	}
 }
 
-func server(c net.Conn) {
-	defer c.Close()
+// procTime accumulates server processing times
+type procTime struct {
+	sum   uint64 // nano-seconds
+	count uint64
+}
 
-	// Insert our hostname in the first packet
-	p := make([]byte, 64)
-	if _, err := io.ReadFull(c, p); err != nil {
-		return
-	}
-	if host, err := os.Hostname(); err == nil {
-		copy(p[:], host)
-	}
-	if _, err := c.Write(p); err != nil {
-		return
+// The processing times for TCP (with -server_timing) and UDP are kept
+// apart since they differ a lot
+var serverProc, udpProc procTime
+
+func (p *procTime) add(d time.Duration) {
+	atomic.AddUint64(&p.sum, uint64(d))
+	atomic.AddUint64(&p.count, 1)
+}
+
+func (p *procTime) meanUs() uint32 {
+	count := atomic.LoadUint64(&p.count)
+	if count == 0 {
+		return 0
 	}
+	return uint32(atomic.LoadUint64(&p.sum) / count / 1000)
+}
 
-	io.Copy(c, c)
+// newPayloadFiller returns a function that fills server responses
+// according to -server_payload, or nil for "echo". A "fixed" pattern
+// continues over consecutive calls.
+func newPayloadFiller(spec string) (func(p []byte), error) {
+	switch {
+	case spec == "echo":
+		return nil, nil
+	case spec == "zeros":
+		return func(p []byte) {
+			for i := range p {
+				p[i] = 0
+			}
+		}, nil
+	case spec == "random":
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		return func(p []byte) {
+			rnd.Read(p)
+		}, nil
+	case strings.HasPrefix(spec, "fixed:"):
+		pattern, err := hex.DecodeString(strings.TrimPrefix(spec, "fixed:"))
+		if err != nil {
+			return nil, err
+		}
+		if len(pattern) == 0 {
+			return nil, errors.New("empty fixed payload")
+		}
+		off := 0
+		return func(p []byte) {
+			for i := range p {
+				p[i] = pattern[off]
+				off = (off + 1) % len(pattern)
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported server payload; %s", spec)
 }
 
 // ----------------------------------------------------------------------
 // Statistics
 
+// forever is the -timeout in continuous mode
+const forever = time.Duration(1<<63 - 1)
+
 type statistics struct {
+	RunID             string `json:",omitempty"`
 	Started           time.Time
-	Duration          time.Duration
+	Duration          time.Duration // The actual run time
+	RequestedDuration time.Duration `json:",omitempty"` // -timeout, none in continuous mode
 	Rate              float64
 	Connections       int
 	PacketSize        uint32
@@ -650,10 +3952,37 @@ type statistics struct {
 	Sent              uint32
 	Received          uint32
 	Dropped           uint32
+	ReceivedBytes     uint64 `json:",omitempty"`
 	Retransmits       uint32
 	FailedConnects    uint32
-	ConnStats         []connstats `json:",omitempty"`
-	Samples           []sample    `json:",omitempty"`
+	UDPRcvBuf         uint32 `json:",omitempty"`
+	UDPSndBuf         uint32 `json:",omitempty"`
+	Payload           string `json:",omitempty"`
+	MinPsize          uint32 `json:",omitempty"`
+	MaxPsize          uint32 `json:",omitempty"`
+	AddressFamily     string `json:",omitempty"`
+	TimeWaitCount     int    `json:",omitempty"`
+	SendJitterMs      uint32 `json:",omitempty"`
+	PacketTimeoutMs   uint32 `json:",omitempty"`
+
+	SuccessfulReconnects uint32 `json:",omitempty"`
+	MaxRetriesPerConn    uint32 `json:",omitempty"`
+	Failovers            uint32 `json:",omitempty"`
+	SamplesTruncated     bool   `json:",omitempty"`
+
+	ClientTypeCounts map[string]int `json:",omitempty"`
+
+	DestStats map[string]destStats `json:",omitempty"`
+
+	// ConnStats and Samples must be last, see encode()
+	ConnStats []connstats `json:",omitempty"`
+	Samples   []sample    `json:",omitempty"`
+
+	interval   time.Duration
+	maxSamples int
+	endless    bool       // continuous mode
+	timedOut   bool       // ended by -timeout, not interrupted
+	conns      []connData // Encoded as ConnStats, see copyStats()
 }
 
 type connstats struct {
@@ -667,39 +3996,136 @@ type connstats struct {
 	Retransmits uint32
 	Local       string
 	Remote      string
-	Host        string `json:",omitempty"`
+	Host        string   `json:",omitempty"`
+	Samples     []sample `json:",omitempty"`
+
+	ServerConnID   uint32          `json:",omitempty"`
+	RTT            time.Duration   `json:",omitempty"`
+	TCPInfoHistory []tcpinfoSample `json:",omitempty"`
+	WriteTimeouts  uint32          `json:",omitempty"`
+	MinPsize       uint32          `json:",omitempty"`
+	MaxPsize       uint32          `json:",omitempty"`
+	FinalPsize     uint32          `json:",omitempty"`
+	HalfCloseHang  bool            `json:",omitempty"`
+	TeardownMs     uint32          `json:",omitempty"`
+	SpoofedReplies uint32          `json:",omitempty"`
+	ECN            bool            `json:",omitempty"`
+	ECNMarksSeen   uint32          `json:",omitempty"`
+	ErrType        string          `json:",omitempty"`
+	OWD            time.Duration   `json:",omitempty"`
+	Conn           int             `json:",omitempty"`
+	Retries        uint32          `json:",omitempty"`
+	HostChanges    uint32          `json:",omitempty"`
+
+	ReceivedBytes    uint64       `json:",omitempty"`
+	AssignedRateMBps float64      `json:",omitempty"`
+	TimestampDeltaUs []int64      `json:",omitempty"`
+	RTTHistogram     rttHistogram `json:",omitempty"`
+}
+
+// tcpinfoSample is a snapshot of TCP info. Rtt is in micro-seconds
+// and Cwnd in segments.
+type tcpinfoSample struct {
+	Time        time.Duration
+	Rtt         uint32
+	Cwnd        uint32
+	Retransmits uint32
+}
+
+type destStats struct {
+	Connections       int
+	FailedConnections int
+	MeanRTT           time.Duration
 }
 
 type sample struct {
-	Time     time.Duration
-	Sent     uint32
-	Received uint32
-	Dropped  uint32
+	Time          time.Duration
+	Sent          uint32
+	Received      uint32
+	Dropped       uint32
+	ReceivedBytes uint64 `json:",omitempty"`
+}
+
+// receivedKB returns the KB received from sample "last" to "samp".
+// Stat files without a byte count use the packet size, which is wrong
+// with -adaptive_psize.
+func (s *statistics) receivedKB(last, samp sample) float64 {
+	if samp.ReceivedBytes > 0 {
+		return float64(samp.ReceivedBytes-last.ReceivedBytes) / 1024
+	}
+	return float64((samp.Received - last.Received) * s.PacketSize / 1024)
 }
 
 func newStats(
 	duration time.Duration,
 	rate float64,
 	connections int,
-	packetSize uint32) *statistics {
+	packetSize uint32,
+	interval time.Duration) *statistics {
 
+	nSamples := duration / interval
+	endless := duration == forever
+	if endless {
+		nSamples = 0
+	}
 	s := &statistics{
 		Started:     time.Now(),
 		Duration:    duration,
 		Rate:        rate,
 		Connections: connections,
 		PacketSize:  packetSize,
-		Samples:     make([]sample, 0, duration/time.Second),
+		Samples:     make([]sample, 0, nSamples),
+		interval:    interval,
+		endless:     endless,
+	}
+	if !endless {
+		s.RequestedDuration = duration
+	}
+	return s
+}
+
+// continuous returns true if the test runs until interrupted
+func (s *statistics) continuous() bool {
+	return s.endless
+}
+
+// end returns the test end time. In continuous mode the end is not
+// known in advance so the current time is used.
+func (s *statistics) end() time.Time {
+	if s.continuous() {
+		return time.Now()
+	}
+	return s.Started.Add(s.Duration)
+}
+
+// clientStats creates statistics for a client run
+func (c *config) clientStats() *statistics {
+	s := newStats(*c.timeout, *c.rate, *c.nconn, uint32(*c.psize), *c.statIntvl)
+	s.RunID = *c.runID
+	if *c.maxSamples > 0 && *c.maxSamples < cap(s.Samples) {
+		s.Samples = make([]sample, 0, *c.maxSamples)
+	}
+	s.maxSamples = *c.maxSamples
+	s.AddressFamily = c.addressFamily()
+	s.SendJitterMs = uint32(*c.sendJitter / time.Millisecond)
+	s.PacketTimeoutMs = uint32(*c.pktTmo / time.Millisecond)
+	// The client always sends zero filled packets
+	s.Payload = "zeros"
+	s.MinPsize = uint32(*c.psize)
+	s.MaxPsize = uint32(*c.psize)
+	if *c.adaptive {
+		s.MinPsize = uint32(*c.psizeMin)
+		s.MaxPsize = uint32(*c.psizeMax)
 	}
-	go s.sample()
 	return s
 }
 
 func (s *statistics) sent(n uint32) {
 	atomic.AddUint32(&s.Sent, n)
 }
-func (s *statistics) received(n uint32) {
+func (s *statistics) received(n uint32, bytes int) {
 	atomic.AddUint32(&s.Received, n)
+	atomic.AddUint64(&s.ReceivedBytes, uint64(bytes))
 }
 func (s *statistics) dropped(n uint32) {
 	atomic.AddUint32(&s.Dropped, n)
@@ -710,18 +4136,134 @@ func (s *statistics) failedConnection(n uint32) {
 func (s *statistics) failedConnect(n uint32) {
 	atomic.AddUint32(&s.FailedConnects, n)
 }
+func (s *statistics) failedOver(n uint32) {
+	atomic.AddUint32(&s.Failovers, n)
+}
+
+// successfulReconnect is called when a logical connection is back
+// after "retries" re-connects
+func (s *statistics) successfulReconnect(retries uint32) {
+	atomic.AddUint32(&s.SuccessfulReconnects, 1)
+	for {
+		max := atomic.LoadUint32(&s.MaxRetriesPerConn)
+		if retries <= max ||
+			atomic.CompareAndSwapUint32(&s.MaxRetriesPerConn, max, retries) {
+			return
+		}
+	}
+}
 
+// runTime returns the actual run time, which is shorter than the
+// RequestedDuration if the test was interrupted. A test that ran until
+// -timeout gets the RequestedDuration, the time for connections to
+// close is not included.
+func (s *statistics) runTime() time.Duration {
+	if s.timedOut && s.RequestedDuration > 0 {
+		return s.RequestedDuration
+	}
+	return time.Since(s.Started)
+}
+
+// reportStats sets the Duration to the actual run time
 func (s *statistics) reportStats() {
-	s.Duration = time.Since(s.Started)
-	json.NewEncoder(os.Stdout).Encode(s)
+	s.Duration = s.runTime()
+	w := bufio.NewWriter(os.Stdout)
+	if err := s.encode(w); err != nil {
+		log.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
 }
 
-func (s *statistics) sample() {
-	deadline := s.Started.Add(s.Duration - 1500*time.Millisecond)
-	for time.Now().Before(deadline) {
-		time.Sleep(time.Second)
-		s.Samples = append(
-			s.Samples, sample{time.Since(s.Started), s.Sent, s.Received, s.Dropped})
+// encode writes the statistics in the same format as json.Encoder
+// but the "ConnStats" entries are encoded one by one, so the complete
+// json output is never held in memory. If the connection array is set
+// the entries are copied from it one at the time.
+func (s *statistics) encode(w io.Writer) error {
+	hdr := *s
+	hdr.ConnStats = nil
+	hdr.Samples = nil
+	b, err := json.Marshal(&hdr)
+	if err != nil {
+		return err
+	}
+	// Remove the closing '}'
+	if _, err = w.Write(b[:len(b)-1]); err != nil {
+		return err
+	}
+
+	n := len(s.ConnStats)
+	if s.conns != nil {
+		n = len(s.conns)
+	}
+	if n > 0 {
+		if _, err = io.WriteString(w, `,"ConnStats":[`); err != nil {
+			return err
+		}
+		var cs connstats
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				if _, err = io.WriteString(w, ","); err != nil {
+					return err
+				}
+			}
+			p := &cs
+			if s.conns != nil {
+				cs = connstats{}
+				copyConnStats(s, &cs, &s.conns[i])
+			} else {
+				p = &s.ConnStats[i]
+			}
+			if b, err = json.Marshal(p); err != nil {
+				return err
+			}
+			if _, err = w.Write(b); err != nil {
+				return err
+			}
+		}
+		if _, err = io.WriteString(w, "]"); err != nil {
+			return err
+		}
+	}
+
+	if len(s.Samples) > 0 {
+		if b, err = json.Marshal(s.Samples); err != nil {
+			return err
+		}
+		if _, err = io.WriteString(w, `,"Samples":`); err != nil {
+			return err
+		}
+		if _, err = w.Write(b); err != nil {
+			return err
+		}
+	}
+
+	_, err = io.WriteString(w, "}\n")
+	return err
+}
+
+// sample takes samples on a fixed schedule. A ticker is used since
+// sleeping for the interval accumulates overshoots. In continuous mode
+// samples are taken until the context is done.
+func (s *statistics) sample(ctx context.Context) {
+	deadline := s.Started.Add(s.Duration - s.interval*3/2)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for s.continuous() || time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.maxSamples > 0 && len(s.Samples) >= s.maxSamples {
+			s.SamplesTruncated = true
+			return
+		}
+		s.Samples = append(s.Samples, sample{
+			time.Since(s.Started), atomic.LoadUint32(&s.Sent),
+			atomic.LoadUint32(&s.Received), atomic.LoadUint32(&s.Dropped),
+			atomic.LoadUint64(&s.ReceivedBytes)})
 	}
 }
 
@@ -751,41 +4293,152 @@ func (c *config) udpServerMain() int {
 	if err := setUDPSocketOptions(conn); err != nil {
 		log.Fatal(err)
 	}
-
-	host, err := os.Hostname()
-	if err != nil {
-		host = ""
+	if *c.udpRcvbuf > 0 || *c.udpSndbuf > 0 {
+		rcvbuf, sndbuf, err := setUDPBuffers(conn, *c.udpRcvbuf, *c.udpSndbuf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("UDP rcvbuf %d, sndbuf %d\n", rcvbuf, sndbuf)
 	}
 
-	buf := make([]byte, 64*1024)
+	host := serverHost()
+
+	fill, _ := newPayloadFiller(*c.payload)
+	// One extra byte to detect oversized packets
+	buf := make([]byte, *c.srvMaxPkt+1)
 	oob := make([]byte, 2048)
+	nextExpire := time.Now().Add(*c.flowTmo)
 	for {
-		//n, oobn, flags, addr, err
-		n, oobn, _, addr, err := conn.ReadMsgUDP(buf, oob)
+		n, oobn, flags, addr, err := conn.ReadMsgUDPAddrPort(buf, oob)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if n > *c.srvMaxPkt || flags&syscall.MSG_TRUNC != 0 {
+			atomic.AddUint32(&oversizedPkts, 1)
+			debugf("UDP oversized packet from %s; discarded", addr)
+			continue
+		}
 		oobd := oob[:oobn]
 
+		now := time.Now()
+		udpFlows.update(addr, now)
+		if now.After(nextExpire) {
+			udpFlows.expire(now.Add(-*c.flowTmo))
+			debugf("UDP flows; %d active", udpFlows.active())
+			nextExpire = now.Add(*c.flowTmo / 2)
+		}
+
+		if fill != nil {
+			fill(buf[:n])
+			if len(host) < n {
+				buf[len(host)] = 0
+			}
+		}
 		copy(buf[:], host)
 
-		_, _, err = conn.WriteMsgUDP(buf[:n], correctSource(oobd), addr)
+		_, _, err = conn.WriteMsgUDPAddrPort(buf[:n], correctSource(oobd), addr)
 		if err != nil {
 			log.Fatal(err)
 		}
+		udpProc.add(time.Since(now))
+	}
+}
+
+// serverFlow is the server state for an UDP client
+type serverFlow struct {
+	started  time.Time
+	packets  atomic.Uint64
+	lastSeen atomic.Int64 // Unix nano-seconds
+}
+
+// flowTable holds UDP server flows keyed by client address. A flow
+// that is expired and re-appears, e.g. after a client restart, gets
+// new counters. The table is updated and expired by the server read
+// loop only, so the loop reads the map without the lock. The lock is
+// taken when flows are added or removed, and by the other goroutines.
+type flowTable struct {
+	mu    sync.Mutex
+	flows map[netip.AddrPort]*serverFlow
+}
+
+var udpFlows = flowTable{flows: make(map[netip.AddrPort]*serverFlow)}
+
+// update counts a packet on a flow. It is called for every received
+// packet and does not lock or allocate, except for new flows.
+func (t *flowTable) update(addr netip.AddrPort, now time.Time) {
+	f, ok := t.flows[addr]
+	if !ok {
+		debugf("UDP flow %s; new", addr)
+		f = &serverFlow{started: now}
+		t.mu.Lock()
+		t.flows[addr] = f
+		t.mu.Unlock()
+	}
+	f.packets.Add(1)
+	f.lastSeen.Store(now.UnixNano())
+}
+
+// expire removes flows not seen since "limit"
+func (t *flowTable) expire(limit time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, f := range t.flows {
+		if f.lastSeen.Load() < limit.UnixNano() {
+			debugf("UDP flow %s; expired after %d packets", addr, f.packets.Load())
+			delete(t.flows, addr)
+		}
+	}
+}
+
+func (t *flowTable) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.flows)
+}
+
+// activeSince returns the number of flows seen since "limit". Flows
+// are only expired when packets are received.
+func (t *flowTable) activeSince(limit time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, f := range t.flows {
+		if f.lastSeen.Load() >= limit.UnixNano() {
+			n++
+		}
 	}
+	return n
 }
 
 func (c *config) udpClientMain() int {
-	s := newStats(*c.timeout, *c.rate, *c.nconn, uint32(*c.psize))
-	rand.Seed(time.Now().UnixNano())
+	c.setCPUAffinity()
+	c.openNetns()
+	c.resolveDestinations()
+	c.rateFromPct()
+	s := c.clientStats()
+	c.runUDPClient(s)
+	c.printStats(s)
+	if *c.pushGw != "" {
+		c.pushStats(s)
+	}
+	return c.checkThresholds(s)
+}
+
+// runUDPClient runs the UDP clients until the test ends
+func (c *config) runUDPClient(s *statistics) {
+	randSeed = time.Now().UnixNano()
+	rand.Seed(randSeed)
 
-	// The connection array will not contain re-connects for UDP
-	cData = make([]connData, *c.nconn)
+	// The connection array may contain re-connects
+	cData = make([]connData, (*c.nconn)*(*c.retries))
+	nConn = 0
+	checkOpenFiles(*c.nconn)
 
 	deadline := time.Now().Add(*c.timeout)
 	ctx, cancel := context.WithDeadline(context.Background(), deadline)
 	defer cancel()
+	ctx, cancel = c.notifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
 	if *c.srccidr != "" {
 		var err error
@@ -794,7 +4447,7 @@ func (c *config) udpClientMain() int {
 			log.Fatal("Set source failed:", err)
 		}
 	} else if *c.srcfile != "" {
-		c.adrgen = readAddresses(*c.srcfile)
+		c.adrgen = c.readSources()
 	}
 
 	var wg sync.WaitGroup
@@ -803,27 +4456,130 @@ func (c *config) udpClientMain() int {
 		go c.udpClient(ctx, &wg, s)
 	}
 
-	if *c.monitor {
-		go monitor(s)
-	}
+	bgctx, bgcancel := context.WithCancel(ctx)
+	bg := c.background(bgctx, s)
 
 	wg.Wait()
+	bgcancel()
+	bg.Wait()
+	// The UDP connections end when the next packet can't be sent
+	// before the deadline, so only an interrupt is checked
+	s.timedOut = !errors.Is(ctx.Err(), context.Canceled)
+}
 
-	c.printStats(s)
+type udpConn struct {
+	cd    *connData
+	conn  *net.UDPConn
+	daddr *net.UDPAddr
+	gso   bool
+	oob   []byte // For receive timestamps
+}
 
-	return 0
+// setUDPBuffers sets the socket buffer sizes if > 0 and returns the
+// actual sizes. The OS may cap the sizes (net.core.rmem_max and
+// wmem_max) and Linux doubles them for bookkeeping overhead.
+func setUDPBuffers(conn *net.UDPConn, rcvbuf, sndbuf int) (int, int, error) {
+	if rcvbuf > 0 {
+		if err := conn.SetReadBuffer(rcvbuf); err != nil {
+			return 0, 0, err
+		}
+	}
+	if sndbuf > 0 {
+		if err := conn.SetWriteBuffer(sndbuf); err != nil {
+			return 0, 0, err
+		}
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if rcvbuf, serr = syscall.GetsockoptInt(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); serr != nil {
+			return
+		}
+		sndbuf, serr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return rcvbuf, sndbuf, serr
 }
 
-type udpConn struct {
-	cd   *connData
-	conn *net.UDPConn
+// From linux/udp.h
+const (
+	udpSegment        = 103
+	udpMaxSegments    = 64
+	udpMaxPayloadSize = 65507
+)
+
+// enableGSO makes the kernel split writes into packets of "psize"
+func (c *udpConn) enableGSO() {
+	if err := c.setSegment(c.cd.psize); err != nil {
+		log.Println("WARNING: UDP GSO not supported;", err)
+		return
+	}
+	c.gso = true
+}
+
+func (c *udpConn) setSegment(size int) error {
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_UDP, udpSegment, size)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// write sends "n" packets of "psize" from "p". With GSO this is done
+// in one write. If the GSO write fails GSO is disabled and the packets
+// are sent one by one.
+func (c *udpConn) write(p []byte, n int) error {
+	psize := c.cd.psize
+	if c.gso {
+		_, err := c.conn.WriteToUDP(p[:n*psize], c.daddr)
+		if err == nil {
+			return nil
+		}
+		log.Println("WARNING: UDP GSO write failed, GSO disabled;", err)
+		c.gso = false
+		if err := c.setSegment(0); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < n; i++ {
+		if _, err := c.conn.WriteToUDP(p[i*psize:(i+1)*psize], c.daddr); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c *config) udpClient(
 	ctx context.Context, wg *sync.WaitGroup, s *statistics) {
 	defer wg.Done()
 
+	var cd *connData
+	var backoff time.Duration
 	for {
+		if cd != nil {
+			// Re-connect after -retry_delay and a back-off
+			if backoff < time.Second {
+				backoff += 100 * time.Millisecond
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(*c.retryDelay + backoff):
+			}
+		}
 
 		// Check that we have > 1sec until deadline
 		deadline, _ := ctx.Deadline()
@@ -832,16 +4588,13 @@ func (c *config) udpClient(
 		}
 
 		// Initiate a new connection
-		id := atomic.AddUint32(&nConn, 1) - 1
-		if int(id) >= len(cData) {
-			c.printStats(s)
-			log.Fatal("Too many re-connects: ", id)
-		}
-		cd := &cData[id]
-		cd.id = id
+		cd = c.connSlot(s, cd)
+		id := cd.id
 		cd.started = time.Now()
+		cd.rnd = newConnRand(id)
 		cd.psize = *c.psize
 		cd.rate = *c.rate / float64(*c.nconn)
+		cd.pktTimeout = *c.pktTmo
 		var saddr *net.UDPAddr
 		if c.adrgen != nil {
 			var err error
@@ -857,26 +4610,61 @@ func (c *config) udpClient(
 			}
 		}
 
-		daddr, err := net.ResolveUDPAddr("udp", *c.addr)
+		daddr, err := net.ResolveUDPAddr("udp", c.daddrs[int(id)%len(c.daddrs)])
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		conn, err := net.DialUDP("udp", saddr, daddr)
+		// A connected socket would silently drop replies from other
+		// addresses than "daddr", so an unconnected socket is used.
+		// Without a source address it is bound to the address the
+		// routing selects, and a free port.
+		var conn *net.UDPConn
+		err = inNetns(func() error {
+			laddr := saddr
+			if laddr == nil {
+				dconn, err := net.DialUDP("udp", nil, daddr)
+				if err != nil {
+					return err
+				}
+				laddr = &net.UDPAddr{IP: dconn.LocalAddr().(*net.UDPAddr).IP}
+				dconn.Close()
+			}
+			var err error
+			conn, err = net.ListenUDP("udp", laddr)
+			return err
+		})
 		if err != nil {
 			log.Fatal(err)
 		}
-		defer conn.Close()
+		if *c.udpRcvbuf > 0 || *c.udpSndbuf > 0 {
+			rcvbuf, sndbuf, err := setUDPBuffers(conn, *c.udpRcvbuf, *c.udpSndbuf)
+			if err != nil {
+				log.Fatal(err)
+			}
+			debugf("Conn %d: rcvbuf %d, sndbuf %d", id, rcvbuf, sndbuf)
+			atomic.StoreUint32(&s.UDPRcvBuf, uint32(rcvbuf))
+			atomic.StoreUint32(&s.UDPSndBuf, uint32(sndbuf))
+		}
 		cd.connected = time.Now()
 
-		udpConn := udpConn{cd, conn}
+		udpConn := udpConn{cd: cd, conn: conn, daddr: daddr}
+		if *c.udpGso > 0 {
+			udpConn.enableGSO()
+		}
+		if *c.pktTs {
+			if err := udpConn.enableTimestamps(); err != nil {
+				log.Fatal("-pkt_timestamp; ", err)
+			}
+		}
 		cd.err = udpConn.Run(ctx, s)
+		conn.Close()
 		if cd.err == nil {
 			// NOTE: The connection *will* stop prematurely if the
 			// next packet can't be sent before the dead-line. However
 			// the stasistics should show that the connection exists
 			// to the test end.
-			cd.ended = s.Started.Add(s.Duration)
+			cd.ended = s.end()
 			return // OK return
 		}
 		cd.ended = time.Now()
@@ -884,53 +4672,180 @@ func (c *config) udpClient(
 }
 
 func (c *udpConn) Run(ctx context.Context, s *statistics) error {
-	defer c.conn.Close()
-
 	c.cd.local = c.conn.LocalAddr().String()
-	c.cd.remote = c.conn.RemoteAddr().String()
+	c.cd.remote = c.daddr.String()
 
-	lim := newLimiter(ctx, c.cd.rate, c.cd.psize)
+	lim := newLimiter(ctx, c.cd.rnd, c.cd.rate, c.cd.psize)
 	if lim == nil {
 		return nil
 	}
 
-	p := make([]byte, c.cd.psize)
+	maxBatch := 1
+	if c.gso {
+		maxBatch = udpMaxPayloadSize / c.cd.psize
+		if maxBatch > udpMaxSegments {
+			maxBatch = udpMaxSegments
+		}
+	}
+	buf := make([]byte, c.cd.psize*maxBatch)
+	p := buf[:c.cd.psize]
 	for {
 		if lim.WaitN(ctx, c.cd.psize) != nil {
 			break
 		}
 
-		if _, err := c.conn.Write(p); err != nil {
+		// With GSO available tokens are sent in the same write
+		// instead of being dropped
+		n := 1
+		for c.gso && n < maxBatch && lim.AllowN(time.Now(), c.cd.psize) {
+			n++
+		}
+		if err := c.write(buf, n); err != nil {
 			return err
 		}
-		c.cd.sent++
-		s.sent(1)
+		c.cd.sent += uint32(n)
+		s.sent(uint32(n))
 
 		for lim.AllowN(time.Now(), c.cd.psize) {
 			c.cd.nPacketsDropped++
 			s.dropped(1)
 		}
 
-		if err := c.conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.cd.pktTimeout)); err != nil {
 			return err
 		}
-		_, _, err := c.conn.ReadFrom(p)
-		if err != nil {
-			// Probably a timeout, i.e. a lost packet
-			continue
+		for i := 0; i < n; {
+			_, oobn, _, addr, err := c.conn.ReadMsgUDP(p, c.oob)
+			if err != nil {
+				// Probably a timeout, i.e. a lost packet
+				break
+			}
+			if !addr.IP.Equal(c.daddr.IP) || addr.Port != c.daddr.Port {
+				// E.g. an anycast reply from another node
+				c.cd.spoofedReplies++
+				continue
+			}
+			i++
+			if oobn > 0 {
+				c.cd.addTimestamp(c.oob[:oobn])
+			}
+
+			if c.cd.nPacketsReceived == 0 {
+				// First received packet _may_ contain a hostname
+				if n := bytes.IndexByte(p, 0); n > 0 {
+					c.cd.host = string(p[:n])
+				}
+			}
+
+			c.cd.received(s, c.cd.psize)
 		}
+	}
+	return nil
+}
 
-		if c.cd.nPacketsReceived == 0 {
-			// First received packet _may_ contain a hostname
-			if n := bytes.IndexByte(p, 0); n > 0 {
-				c.cd.host = string(p[:n])
+// ----------------------------------------------------------------------
+// MTU probe
+
+// mtuProbeMain probes the MTU to all destinations
+func (c *config) mtuProbeMain() int {
+	c.resolveDestinations()
+	for _, a := range c.daddrs {
+		mtu := probeMTU(a, *c.pktTmo)
+		if len(c.daddrs) > 1 {
+			fmt.Printf("MTU: %d bytes (%s)\n", mtu, a)
+		} else {
+			fmt.Printf("MTU: %d bytes\n", mtu)
+		}
+	}
+	return 0
+}
+
+// probeMTU sends UDP packets with increasing size and "don't
+// fragment" set to an UDP server. When a size fails the sizes between
+// the largest working and the failing one are bisected. A reply is
+// waited for at most tmo. The returned MTU includes the IP and UDP
+// headers.
+func probeMTU(addr string, tmo time.Duration) int {
+	daddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, daddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	hdr := 40 + 8
+	if daddr.IP.To4() != nil {
+		hdr = 20 + 8
+	}
+	if err := setDontFragment(conn, hdr == 20+8); err != nil {
+		log.Fatal(err)
+	}
+
+	buf := make([]byte, 64*1024)
+	probe := func(size int) bool {
+		// Try a few times since packets may be lost
+		for i := 0; i < 3; i++ {
+			if _, err := conn.Write(buf[:size]); err != nil {
+				// Probably EMSGSIZE, larger than the local MTU
+				debugf("Size %d; %v", size, err)
+				return false
+			}
+			if err := conn.SetReadDeadline(time.Now().Add(tmo)); err != nil {
+				log.Fatal(err)
+			}
+			if n, err := conn.Read(buf); err == nil && n == size {
+				debugf("Size %d; OK", size)
+				return true
 			}
 		}
+		debugf("Size %d; no reply", size)
+		return false
+	}
 
-		c.cd.nPacketsReceived++
-		s.received(1)
+	good, bad := 0, 0
+	for _, size := range []int{64, 128, 256, 512, 1024, 2048, 4096, 8192, 9000} {
+		if !probe(size) {
+			bad = size
+			break
+		}
+		good = size
 	}
-	return nil
+	if good == 0 {
+		log.Fatal("No reply on MTU probe to ", addr)
+	}
+	for bad-good > 1 {
+		size := (good + bad) / 2
+		if probe(size) {
+			good = size
+		} else {
+			bad = size
+		}
+	}
+	return good + hdr
+}
+
+func setDontFragment(conn *net.UDPConn, ipv4 bool) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if ipv4 {
+			serr = syscall.SetsockoptInt(
+				int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_DO)
+		} else {
+			serr = syscall.SetsockoptInt(
+				int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_DO)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return serr
 }
 
 /*
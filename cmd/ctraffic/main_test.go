@@ -0,0 +1,821 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"go.uber.org/goleak"
+)
+
+// testConfig returns a config with the options parsed from "args"
+func testConfig(t testing.TB, args ...string) *config {
+	t.Helper()
+	fs := flag.NewFlagSet("ctraffic", flag.ContinueOnError)
+	c := newConfig(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	c.setup(fs)
+	return c
+}
+
+// testServer starts an echo server on a free port and returns the
+// address
+func testServer(t testing.TB, args ...string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := testConfig(t, append([]string{"-server"}, args...)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			sconns.add(conn)
+			go func() {
+				defer sconns.remove(conn)
+				c.server(ctx, conn)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		l.Close()
+		<-done
+		sconns.wg.Wait()
+	})
+	return l.Addr().String()
+}
+
+// runTestClient runs a TCP client with the options in "args"
+func runTestClient(t testing.TB, args ...string) *statistics {
+	t.Helper()
+	return runTestConfig(testClientConfig(t, args...))
+}
+
+// testClientConfig returns a client config without statistics output
+func testClientConfig(t testing.TB, args ...string) *config {
+	t.Helper()
+	return testConfig(t, append([]string{"-stats", "none"}, args...)...)
+}
+
+// runTestConfig runs a client with a config from testClientConfig()
+func runTestConfig(c *config) *statistics {
+	c.resolveDestinations()
+	s := c.clientStats()
+	c.runClient(s)
+	return s
+}
+
+// testSignals replaces signal.Notify in a config. The channel that the
+// code under test registers for a signal is passed on, so a signal is
+// sent when the code is ready, and the test process is not signaled.
+type testSignals map[os.Signal]chan chan<- os.Signal
+
+func newTestSignals(c *config, sigs ...os.Signal) testSignals {
+	ts := make(testSignals)
+	for _, sig := range sigs {
+		ts[sig] = make(chan chan<- os.Signal, 1)
+	}
+	c.notify = func(ch chan<- os.Signal, sigs ...os.Signal) {
+		for _, sig := range sigs {
+			if r, ok := ts[sig]; ok {
+				r <- ch
+			}
+		}
+	}
+	return ts
+}
+
+// send waits until "sig" is registered and sends it
+func (ts testSignals) send(sig os.Signal) {
+	(<-ts[sig]) <- sig
+}
+
+func TestAllConnectionsGetTraffic(t *testing.T) {
+	addr := testServer(t)
+	const nconn = 20
+	runTestClient(t, "-address", addr, "-nconn", "20", "-goroutines", "20",
+		"-timeout", "3s", "-rate", "20")
+	received := make(map[int]uint32)
+	for i := range cData[:nConn] {
+		received[cData[i].conn] += cData[i].nPacketsReceived
+	}
+	for i := 0; i < nconn; i++ {
+		if received[i] == 0 {
+			t.Errorf("Connection %d got no traffic", i)
+		}
+	}
+}
+
+// TestGoroutinePool checks that with fewer -goroutines than -nconn
+// the queued connections are started when a connection ends
+func TestGoroutinePool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var active, maxActive int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				n := atomic.AddInt32(&active, 1)
+				for {
+					max := atomic.LoadInt32(&maxActive)
+					if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+						break
+					}
+				}
+				// Echo one packet and close
+				p := make([]byte, 1024)
+				if _, err := io.ReadFull(conn, p); err == nil {
+					conn.Write(p)
+				}
+				atomic.AddInt32(&active, -1)
+				conn.Close()
+			}()
+		}
+	}()
+
+	const nconn = 6
+	runTestClient(t, "-address", l.Addr().String(), "-nconn", "6",
+		"-goroutines", "2", "-reconnect=false", "-timeout", "5s", "-rate", "20")
+	received := make(map[int]uint32)
+	for i := range cData[:nConn] {
+		received[cData[i].conn] += cData[i].nPacketsReceived
+	}
+	for i := 0; i < nconn; i++ {
+		if received[i] == 0 {
+			t.Errorf("Connection %d got no traffic", i)
+		}
+	}
+	if max := atomic.LoadInt32(&maxActive); max > 2 {
+		t.Errorf("%d concurrent connections with -goroutines 2", max)
+	}
+}
+
+func TestWithPortProperties(t *testing.T) {
+	// "localhost" is the hostname since it resolves without DNS
+	cases := []string{
+		"[::1]", "[::1]:80", "1.2.3.4", "1.2.3.4:80", "::1",
+		"localhost", "localhost:80",
+	}
+	for _, a := range cases {
+		p := withPort(a)
+		if _, err := net.ResolveTCPAddr("tcp", p); err != nil {
+			t.Errorf("withPort(%q) = %q; %v", a, p, err)
+		}
+		if pp := withPort(p); pp != p {
+			t.Errorf("withPort(%q) = %q, not idempotent; %q", a, p, pp)
+		}
+	}
+
+	// Addresses on the forms the source options take
+	f := func(ip [16]byte, v4, bracket, port bool, n uint16) bool {
+		a := net.IP(ip[:]).String()
+		if v4 {
+			a = net.IP(ip[:4]).String()
+		} else if bracket {
+			a = "[" + a + "]"
+		}
+		if port {
+			a = net.JoinHostPort(strings.Trim(a, "[]"), strconv.Itoa(int(n)))
+		}
+		p := withPort(a)
+		if _, err := net.ResolveTCPAddr("tcp", p); err != nil {
+			t.Logf("withPort(%q) = %q; %v", a, p, err)
+			return false
+		}
+		return withPort(p) == p
+	}
+	if err := quick.Check(f, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+// BenchmarkClientMain runs 3s clients, the shortest run where the
+// connections are started, with different number of connections
+func BenchmarkClientMain(b *testing.B) {
+	addr := testServer(b)
+	for _, nconn := range []int{1, 10, 100, 1000} {
+		b.Run(fmt.Sprintf("nconn=%d", nconn), func(b *testing.B) {
+			var bytes float64
+			for i := 0; i < b.N; i++ {
+				s := runTestClient(b, "-address", addr, "-nconn", strconv.Itoa(nconn),
+					"-timeout", "3s", "-rate", "100000")
+				bytes += float64(s.Received) * float64(s.PacketSize)
+			}
+			b.ReportMetric(bytes/float64(b.N), "bytes/op")
+		})
+	}
+}
+
+// TestNoGoroutineLeak checks that all goroutines of a client run have
+// exited when it returns. The cleanups run in reverse order so the
+// check is done after the server is stopped.
+func TestNoGoroutineLeak(t *testing.T) {
+	ignore := goleak.IgnoreCurrent()
+	t.Cleanup(func() { goleak.VerifyNone(t, ignore) })
+	addr := testServer(t)
+	// Connections are not started with less than 2s left
+	runTestClient(t, "-address", addr, "-nconn", "5", "-timeout", "3s",
+		"-monitor", "-delta_interval", "500ms", "-delta_file", os.DevNull)
+}
+
+// BenchmarkCopyStats measures the copy and encoding of the connection
+// statistics. The ConnStats are encoded straight from the connection
+// array so only one entry is held at the time. The allocations are the
+// json.Marshal() of each entry.
+//
+// This replaced the parallel copy of the connection array in chunks of
+// 1000 to a ConnStats array. The copy was ~10% of the time and the
+// encoding the rest, so with 100k entries the run time was the same,
+// ~370ms, but 44MB were allocated instead of 16MB.
+func BenchmarkCopyStats(b *testing.B) {
+	c := testConfig(b, "-stats", "all")
+	for _, n := range []int{10000, 100000} {
+		cData = make([]connData, n)
+		nConn = uint32(n)
+		s := newStats(time.Second, 1, n, 1024, time.Second)
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c.copyStats(s)
+				if err := s.encode(io.Discard); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEchoHotPath reports the allocations per packet in a client
+// run. For a profile use;
+//
+//	go test -run XXX -bench EchoHotPath -memprofile /tmp/mem.out
+func BenchmarkEchoHotPath(b *testing.B) {
+	addr := testServer(b)
+	var ms runtime.MemStats
+	for i := 0; i < b.N; i++ {
+		runtime.ReadMemStats(&ms)
+		mallocs := ms.Mallocs
+		s := runTestClient(b, "-address", addr, "-timeout", "3s", "-rate", "100000")
+		runtime.ReadMemStats(&ms)
+		b.ReportMetric(float64(ms.Mallocs-mallocs)/float64(s.Received), "allocs/pkt")
+	}
+}
+
+// BenchmarkUDPWrite compares GSO and non-GSO writes for the same
+// number of packets. An op is 16 packets.
+func BenchmarkUDPWrite(b *testing.B) {
+	sink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	go io.Copy(io.Discard, sink)
+
+	const psize, batch = 1024, 16
+	for _, gso := range []bool{false, true} {
+		b.Run(fmt.Sprintf("gso=%v", gso), func(b *testing.B) {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				b.Fatal(err)
+			}
+			c := udpConn{
+				cd:    &connData{psize: psize},
+				conn:  conn,
+				daddr: sink.LocalAddr().(*net.UDPAddr),
+			}
+			defer c.conn.Close()
+			if gso {
+				if c.enableGSO(); !c.gso {
+					b.Skip("UDP GSO not supported")
+				}
+			}
+			buf := make([]byte, psize*batch)
+			b.SetBytes(psize * batch)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.write(buf, batch); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// sendTimes starts an echo server that records the arrival time of
+// every 1024 byte packet
+func sendTimes(t *testing.T) (string, func() []time.Time) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var mu sync.Mutex
+	var times []time.Time
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		p := make([]byte, 1024)
+		for {
+			if _, err := io.ReadFull(conn, p); err != nil {
+				return
+			}
+			mu.Lock()
+			times = append(times, time.Now())
+			mu.Unlock()
+			if _, err := conn.Write(p); err != nil {
+				return
+			}
+		}
+	}()
+	return l.Addr().String(), func() []time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]time.Time(nil), times...)
+	}
+}
+
+func TestSendJitter(t *testing.T) {
+	// The packet interval is 100ms
+	for _, jitter := range []string{"80ms", "300ms"} {
+		t.Run(jitter, func(t *testing.T) {
+			addr, times := sendTimes(t)
+			s := runTestClient(t, "-address", addr, "-rate", "10",
+				"-send_jitter", jitter, "-timeout", "4s")
+			if s.Dropped != 0 {
+				t.Errorf("Dropped %d packets", s.Dropped)
+			}
+			ts := times()
+			if len(ts) < 5 {
+				t.Fatalf("Only %d packets", len(ts))
+			}
+			min, max := time.Hour, time.Duration(0)
+			for i := 1; i < len(ts); i++ {
+				gap := ts[i].Sub(ts[i-1])
+				if gap < min {
+					min = gap
+				}
+				if gap > max {
+					max = gap
+				}
+			}
+			if max-min < 20*time.Millisecond {
+				t.Errorf("Send gaps %v-%v do not vary", min, max)
+			}
+		})
+	}
+}
+
+func TestReloadNconn(t *testing.T) {
+	addr := testServer(t)
+	cfg := t.TempDir() + "/ctraffic.cfg"
+	if err := os.WriteFile(cfg, []byte("nconn 4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := testClientConfig(t, "-address", addr, "-config", cfg, "-nconn", "2",
+		"-max_nconn", "4", "-retries", "1", "-timeout", "4s", "-rate", "20")
+	go newTestSignals(c, syscall.SIGHUP).send(syscall.SIGHUP)
+	s := runTestConfig(c)
+	if s.Connections != 4 {
+		t.Errorf("Connections %d, expected 4", s.Connections)
+	}
+	received := make(map[int]uint32)
+	for i := range cData[:nConn] {
+		received[cData[i].conn] += cData[i].nPacketsReceived
+	}
+	for i := 0; i < 4; i++ {
+		if received[i] == 0 {
+			t.Errorf("Connection %d got no traffic", i)
+		}
+	}
+}
+
+// closingServer starts a server that closes every connection after the
+// first packet
+func closingServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				p := make([]byte, 1024)
+				if _, err := io.ReadFull(conn, p); err == nil {
+					conn.Write(p)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestContinuousReconnects(t *testing.T) {
+	addr := closingServer(t)
+	c := testClientConfig(t, "-address", addr, "-continuous", "-retries", "2",
+		"-rate", "100")
+	sigs := newTestSignals(c, syscall.SIGINT)
+	time.AfterFunc(2*time.Second, func() { sigs.send(syscall.SIGINT) })
+	s := runTestConfig(c)
+	if s.FailedConnections <= 2 {
+		t.Fatalf("FailedConnections %d, expected more than -retries", s.FailedConnections)
+	}
+	if nConn != 1 {
+		t.Errorf("%d connection slots used, expected 1", nConn)
+	}
+	if s.RequestedDuration != 0 {
+		t.Errorf("RequestedDuration %v in continuous mode", s.RequestedDuration)
+	}
+}
+
+func TestStaggerTimeout(t *testing.T) {
+	c := testConfig(t, "-nconn", "5", "-stagger", "1s", "-timeout", "10s")
+	if *c.timeout != 14*time.Second {
+		t.Errorf("timeout %v, expected 14s", *c.timeout)
+	}
+}
+
+func TestRTTHistogram(t *testing.T) {
+	var h rttHistogram
+	for _, rtt := range []time.Duration{
+		500 * time.Nanosecond, time.Microsecond, 3 * time.Microsecond,
+		4 * time.Microsecond, 7 * time.Microsecond, time.Millisecond,
+	} {
+		h.add(rtt)
+	}
+	// 1ms = 1000us is in [512, 1024)
+	expected := rttHistogram{1, 1, 1, 2, 0, 0, 0, 0, 0, 0, 1}
+	if fmt.Sprint(h) != fmt.Sprint(expected) {
+		t.Errorf("histogram %v, expected %v", h, expected)
+	}
+}
+
+func TestAdaptivePsizeBytes(t *testing.T) {
+	addr := testServer(t)
+	s := runTestClient(t, "-address", addr, "-adaptive_psize", "-timeout", "3s",
+		"-rate", "10000")
+	if s.Received < 200 {
+		t.Fatalf("Only %d packets received", s.Received)
+	}
+	if s.ReceivedBytes == uint64(s.Received)*uint64(s.PacketSize) {
+		t.Errorf("ReceivedBytes %d, the packet size is not adapted", s.ReceivedBytes)
+	}
+	var bytes uint64
+	for i := range cData[:nConn] {
+		bytes += cData[i].nBytesReceived
+	}
+	if bytes != s.ReceivedBytes {
+		t.Errorf("Connections received %d bytes, total %d", bytes, s.ReceivedBytes)
+	}
+}
+
+func TestReceivedKB(t *testing.T) {
+	s := &statistics{PacketSize: 1024}
+	last := sample{Received: 10, ReceivedBytes: 10 * 1024}
+	samp := sample{Received: 20, ReceivedBytes: 10*1024 + 10*4096}
+	if kb := s.receivedKB(last, samp); kb != 40 {
+		t.Errorf("receivedKB %v, expected 40", kb)
+	}
+	// Stat files without a byte count
+	last.ReceivedBytes, samp.ReceivedBytes = 0, 0
+	if kb := s.receivedKB(last, samp); kb != 10 {
+		t.Errorf("receivedKB %v, expected 10", kb)
+	}
+}
+
+func TestEncodeConnStats(t *testing.T) {
+	c := testConfig(t, "-stats", "all")
+	cData = make([]connData, 5)
+	nConn = 3
+	for i := range cData {
+		cData[i].sent = uint32(i + 1)
+	}
+	s := newStats(time.Second, 1, 3, 1024, time.Second)
+	c.copyStats(s)
+	var buf strings.Builder
+	if err := s.encode(&buf); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := readStats(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.ConnStats) != 3 {
+		t.Fatalf("%d ConnStats, expected 3", len(rs.ConnStats))
+	}
+	for i, cs := range rs.ConnStats {
+		if cs.Sent != uint32(i+1) {
+			t.Errorf("ConnStats[%d].Sent %d, expected %d", i, cs.Sent, i+1)
+		}
+	}
+}
+
+func TestFlowTableActiveSince(t *testing.T) {
+	ft := flowTable{flows: make(map[netip.AddrPort]*serverFlow)}
+	now := time.Now()
+	ft.update(netip.MustParseAddrPort("10.0.0.1:1"), now.Add(-time.Minute))
+	ft.update(netip.MustParseAddrPort("10.0.0.2:1"), now)
+	if n := ft.activeSince(now.Add(-time.Second)); n != 1 {
+		t.Errorf("%d active flows, expected 1", n)
+	}
+	if n := ft.activeSince(now.Add(-time.Hour)); n != 2 {
+		t.Errorf("%d active flows, expected 2", n)
+	}
+}
+
+// BenchmarkFlowTableUpdate measures the flow update done for every
+// packet in the UDP server. It shall not allocate.
+func BenchmarkFlowTableUpdate(b *testing.B) {
+	ft := flowTable{flows: make(map[netip.AddrPort]*serverFlow)}
+	addrs := make([]netip.AddrPort, 1000)
+	for i := range addrs {
+		addrs[i] = netip.AddrPortFrom(netip.MustParseAddr("1000::1"), uint16(i+1))
+		ft.update(addrs[i], time.Now())
+	}
+	now := time.Now()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ft.update(addrs[i%len(addrs)], now)
+	}
+}
+
+func TestResolveDestinations(t *testing.T) {
+	tests := []struct {
+		family, addr, expected string
+	}{
+		// All addresses of the host are tried on connect
+		{"auto", "localhost:5003", "localhost:5003"},
+		{"ipv4", "localhost:5003", "127.0.0.1:5003"},
+		{"ipv4", "localhost:5003,127.0.0.2:5003", "127.0.0.1:5003,127.0.0.2:5003"},
+	}
+	for _, tc := range tests {
+		c := testConfig(t, "-prefer_family", tc.family, "-address", tc.addr)
+		c.resolveDestinations()
+		if d := strings.Join(c.daddrs, ","); d != tc.expected {
+			t.Errorf("%s %s; destinations %s, expected %s", tc.family, tc.addr, d, tc.expected)
+		}
+	}
+}
+
+// switchWriter replaces the server id "A" with "B" from packet "after",
+// as a load-balancer that moves the connection to another server
+type switchWriter struct {
+	conn         net.Conn
+	psize, after int
+	n            int
+}
+
+func (w *switchWriter) Write(p []byte) (int, error) {
+	if len(p) == w.psize {
+		if w.n++; w.n > w.after {
+			copy(p, "B\x00")
+		}
+	}
+	return w.conn.Write(p)
+}
+
+func TestAlwaysIDLargePsize(t *testing.T) {
+	// The -psize is only limited by -server_max_pkt in the server
+	addr := testServer(t, "-server_always_id", "-psize", "100000",
+		"-server_max_pkt", "100000")
+	runTestClient(t, "-address", addr, "-server_always_id", "-psize", "100000",
+		"-nconn", "2", "-rate", "1000", "-timeout", "3s")
+	for i := range cData[:nConn] {
+		cd := &cData[i]
+		if cd.nPacketsReceived < 2 || cd.host != serverHost() || cd.hostChanges != 0 {
+			t.Errorf("Conn %d: received %d, host %q, host changes %d",
+				i, cd.nPacketsReceived, cd.host, cd.hostChanges)
+		}
+	}
+
+	// A server that switches id after 3 packets
+	const psize = 100000
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				p := make([]byte, 64)
+				if _, err := io.ReadFull(conn, p); err != nil {
+					return
+				}
+				copy(p, "A\x00")
+				if _, err := conn.Write(p); err != nil {
+					return
+				}
+				w := &switchWriter{conn: conn, psize: psize, after: 3}
+				framedEcho(conn, w, psize, len(p), nil, []byte("A\x00"))
+			}()
+		}
+	}()
+	runTestClient(t, "-address", l.Addr().String(), "-server_always_id",
+		"-psize", "100000", "-rate", "1000", "-timeout", "3s")
+	cd := &cData[0]
+	if cd.nPacketsReceived < 6 || cd.host != "B" || cd.hostChanges != 1 {
+		t.Errorf("Received %d, host %q, host changes %d, expected B and 1",
+			cd.nPacketsReceived, cd.host, cd.hostChanges)
+	}
+}
+
+// udpEchoServer starts an UDP echo server
+func udpEchoServer(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestProbeMTU(t *testing.T) {
+	// A server that drops packets larger than 1400 bytes
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if n <= 1400 {
+				conn.WriteToUDP(buf[:n], addr)
+			}
+		}
+	}()
+	if mtu := probeMTU(conn.LocalAddr().String(), 50*time.Millisecond); mtu != 1400+20+8 {
+		t.Errorf("MTU %d, expected %d", mtu, 1400+20+8)
+	}
+}
+
+func TestUDPClientLocalAddr(t *testing.T) {
+	addr := udpEchoServer(t)
+	c := testConfig(t, "-stats", "none", "-udp", "-address", addr, "-nconn", "5",
+		"-timeout", "2s", "-rate", "10")
+	c.udpClientMain()
+	locals := make(map[string]bool)
+	for i := range cData[:nConn] {
+		cd := &cData[i]
+		a, err := net.ResolveUDPAddr("udp", cd.local)
+		if err != nil || !a.IP.Equal(net.IPv4(127, 0, 0, 1)) || a.Port == 0 {
+			t.Errorf("Conn %d: local address %q", i, cd.local)
+		}
+		if locals[cd.local] {
+			t.Errorf("Conn %d: local address %q re-used", i, cd.local)
+		}
+		locals[cd.local] = true
+		if cd.nPacketsReceived == 0 {
+			t.Errorf("Conn %d: no packets received", i)
+		}
+	}
+}
+
+func TestDurationOnTimeout(t *testing.T) {
+	addr := testServer(t)
+	s := runTestClient(t, "-address", addr, "-nconn", "2", "-timeout", "3s",
+		"-rate", "10")
+	if !s.timedOut || s.runTime() != 3*time.Second {
+		t.Errorf("Run time %v after -timeout 3s", s.runTime())
+	}
+
+	// An interrupted test gets the actual run time
+	c := testClientConfig(t, "-address", addr, "-nconn", "2", "-timeout", "4s",
+		"-rate", "10")
+	sigs := newTestSignals(c, syscall.SIGINT)
+	time.AfterFunc(time.Second, func() { sigs.send(syscall.SIGINT) })
+	s = runTestConfig(c)
+	if d := s.runTime(); s.timedOut || d < time.Second || d > 3*time.Second {
+		t.Errorf("Run time %v after interrupt", d)
+	}
+
+	// UDP connections end before the deadline
+	c = testClientConfig(t, "-udp", "-address", udpEchoServer(t), "-nconn", "2",
+		"-timeout", "2s", "-rate", "10")
+	c.resolveDestinations()
+	s = c.clientStats()
+	c.runUDPClient(s)
+	if !s.timedOut || s.runTime() != 2*time.Second {
+		t.Errorf("UDP run time %v after -timeout 2s", s.runTime())
+	}
+}
+
+func TestServerClients(t *testing.T) {
+	serverClients.Range(func(k, v interface{}) bool {
+		serverClients.Delete(k)
+		return true
+	})
+	closedClients.list = nil
+
+	// All pipes have the remote address "pipe"
+	newClient := func() *serverClient {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { c1.Close(); c2.Close() })
+		return newServerClient(c1)
+	}
+	sc1 := newClient()
+	sc1.disconnect(2)
+	sc2 := newClient()
+	sc2.bytes.Store(1024)
+	if l := serverClientsSnapshot(1024); len(l) != 2 ||
+		l[0].Disconnected == nil || l[1].Disconnected != nil || l[1].Packets != 1 {
+		t.Errorf("A re-used address; %+v", l)
+	}
+
+	// The oldest disconnected client is dropped
+	sc2.disconnect(2)
+	sc3 := newClient()
+	sc3.disconnect(2)
+	l := serverClientsSnapshot(1024)
+	if len(l) != 2 || !l[0].Connected.Equal(sc2.connected) ||
+		!l[1].Connected.Equal(sc3.connected) {
+		t.Errorf("Expected 2 latest clients; %+v", l)
+	}
+	for _, cs := range l {
+		if cs.Remote != "pipe" || cs.Disconnected == nil {
+			t.Errorf("Unexpected client; %+v", cs)
+		}
+	}
+	serverClients.Range(func(k, v interface{}) bool {
+		t.Errorf("Disconnected client %v still connected", k)
+		return true
+	})
+}
+
+// TestUDPReconnectBackoff checks that failing UDP connections are
+// re-connected with a back-off. A too large packet fails every write.
+func TestUDPReconnectBackoff(t *testing.T) {
+	addr := udpEchoServer(t)
+	c := testConfig(t, "-stats", "none", "-udp", "-address", addr,
+		"-psize", "70000", "-rate", "1000", "-timeout", "3s")
+	c.udpClientMain()
+	// 100+200+...+700ms < 3s
+	if nConn < 3 || nConn > 8 {
+		t.Errorf("%d connections in 3s", nConn)
+	}
+	if cData[0].err == nil {
+		t.Errorf("Connection did not fail")
+	}
+}
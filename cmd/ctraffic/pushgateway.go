@@ -0,0 +1,92 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+// Push of the final statistics to a Prometheus Pushgateway. The
+// metrics are written in the Prometheus text format so no client
+// library is needed. The job is "ctraffic" and the -run_id (if any) is
+// used as grouping label.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type pushMetric struct {
+	name  string
+	help  string
+	value float64
+}
+
+func pushMetrics(s *statistics, duration time.Duration) []pushMetric {
+	return []pushMetric{
+		{"ctraffic_duration_seconds", "The actual run time", duration.Seconds()},
+		{"ctraffic_connections", "Number of connections", float64(s.Connections)},
+		{"ctraffic_failed_connections", "Connections that failed", float64(s.FailedConnections)},
+		{"ctraffic_failed_connects", "Failed connect attempts", float64(s.FailedConnects)},
+		{"ctraffic_reconnects", "Successful re-connects", float64(s.SuccessfulReconnects)},
+		{"ctraffic_sent_packets", "Sent packets", float64(s.Sent)},
+		{"ctraffic_received_packets", "Received packets", float64(s.Received)},
+		{"ctraffic_dropped_packets", "Packets dropped by the sender", float64(s.Dropped)},
+		{"ctraffic_retransmits", "TCP retransmits", float64(s.Retransmits)},
+		{"ctraffic_rate_kbytes_per_second", "Total requested rate (-rate)", s.Rate},
+		{"ctraffic_packet_size_bytes", "Packet size", float64(s.PacketSize)},
+	}
+}
+
+// writePushMetrics writes the metrics in the Prometheus text format
+func writePushMetrics(w io.Writer, metrics []pushMetric) {
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n",
+			m.name, m.help, m.name, m.name, m.value)
+	}
+}
+
+// pushURL returns the Pushgateway url for the job and grouping label
+func pushURL(gateway, runID string) string {
+	u := strings.TrimSuffix(gateway, "/") + "/metrics/job/ctraffic"
+	if runID != "" {
+		u += "/run_id/" + url.PathEscape(runID)
+	}
+	return u
+}
+
+// pushStats pushes the statistics. A POST replaces metrics with the
+// same name in the group. Errors are logged, the test result is not
+// affected.
+func (c *config) pushStats(s *statistics) {
+	if err := c.push(s); err != nil {
+		log.Println("Push gateway; ", err)
+	}
+}
+
+func (c *config) push(s *statistics) error {
+	// The Duration is the actual run time only if the statistics are printed
+	duration := s.Duration
+	if *c.stats == "none" {
+		duration = s.runTime()
+	}
+	var buf bytes.Buffer
+	writePushMetrics(&buf, pushMetrics(s, duration))
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(
+		pushURL(*c.pushGw, s.RunID), "text/plain; version=0.0.4", &buf)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+// Config file and reload on SIGHUP. The config file has "name value"
+// lines where name is a flag. Flags on the command line take
+// precedence. On SIGHUP the file is read again and "-rate" and
+// "-nconn" are applied to the running test. The connection array and
+// the goroutine pool are allocated for "-max_nconn".
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/time/rate"
+)
+
+// readConfig reads a config file. Empty lines and lines starting with
+// "#" are ignored.
+func readConfig(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	cfg := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, _ := strings.Cut(line, " ")
+		cfg[strings.TrimLeft(name, "-")] = strings.TrimSpace(value)
+	}
+	return cfg, scanner.Err()
+}
+
+// loadConfig sets flags from the config file unless they are given on
+// the command line
+func loadConfig(path string) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for name, value := range cfg {
+		if given[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			log.Fatalf("Config %s; %v", name, err)
+		}
+	}
+}
+
+// reloader applies a re-read config file to the running client
+type reloader struct {
+	c     *config
+	ctx   context.Context
+	s     *statistics
+	wg    *sync.WaitGroup
+	work  chan *clientTask
+	mu    sync.Mutex
+	tasks []*clientTask
+	types []string
+	// The rate per connection is scaled with "factor" (float64 bits)
+	factor   uint64
+	baseRate float64
+	rate     float64
+	nconn    int
+	// Logical connections started. Each may use -retries slots in the
+	// connection array.
+	started int
+}
+
+func (c *config) newReloader(
+	ctx context.Context, s *statistics, wg *sync.WaitGroup,
+	work chan *clientTask, tasks []*clientTask, types []string) *reloader {
+	return &reloader{
+		c:        c,
+		ctx:      ctx,
+		s:        s,
+		wg:       wg,
+		work:     work,
+		tasks:    tasks,
+		types:    types,
+		factor:   math.Float64bits(1),
+		baseRate: *c.rate / float64(*c.nconn),
+		rate:     *c.rate,
+		nconn:    *c.nconn,
+		started:  *c.nconn,
+	}
+}
+
+// rateFactor returns the scaling of the connection rates. A nil
+// reloader returns 1.
+func (r *reloader) rateFactor() float64 {
+	if r == nil {
+		return 1
+	}
+	return math.Float64frombits(atomic.LoadUint64(&r.factor))
+}
+
+// run reloads the config on SIGHUP until the context is done. The
+// reloader holds the WaitGroup since connections may be added.
+func (r *reloader) run() {
+	defer r.wg.Done()
+	hup := make(chan os.Signal, 1)
+	r.c.notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-hup:
+			r.reload()
+		}
+	}
+}
+
+func (r *reloader) reload() {
+	cfg, err := readConfig(*r.c.cfgFile)
+	if err != nil {
+		log.Println("Reload failed; ", err)
+		return
+	}
+	newRate, newNconn := r.rate, r.nconn
+	if v, ok := cfg["rate"]; ok && r.baseRate <= 0 {
+		log.Println("Reload; rate ignored with -rate 0")
+	} else if ok {
+		if newRate, err = strconv.ParseFloat(v, 64); err != nil || newRate <= 0 {
+			log.Println("Reload failed; invalid rate ", v)
+			return
+		}
+	}
+	if v, ok := cfg["nconn"]; ok {
+		if newNconn, err = strconv.Atoi(v); err != nil || newNconn < 1 {
+			log.Println("Reload failed; invalid nconn ", v)
+			return
+		}
+	}
+	if added := newNconn - r.nconn; added > 0 && r.started+added > *r.c.maxNconn {
+		// The slots of stopped connections are not re-used
+		log.Printf("Reload failed; %d connections started, -max_nconn %d\n",
+			r.started+added, *r.c.maxNconn)
+		return
+	}
+	log.Printf("Reload; rate %.1f -> %.1f, nconn %d -> %d\n",
+		r.rate, newRate, r.nconn, newNconn)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	factor := newRate / float64(newNconn) / r.baseRate
+	atomic.StoreUint64(&r.factor, math.Float64bits(factor))
+	for i := 0; i < r.nconn && i < newNconn; i++ {
+		if lim := r.tasks[i].limiter(); lim != nil {
+			lim.SetLimit(rate.Limit(r.tasks[i].rate * factor * 1024.0))
+		}
+	}
+	for i := newNconn; i < r.nconn; i++ {
+		r.tasks[i].stop()
+	}
+	for i := r.nconn; i < newNconn; i++ {
+		t := newClientTask(r.ctx, i, r.types[i%len(r.types)], r.baseRate)
+		if i < len(r.tasks) {
+			r.tasks[i] = t
+		} else {
+			r.tasks = append(r.tasks, t)
+		}
+		r.started++
+		r.wg.Add(1)
+		r.work <- t
+	}
+	r.rate, r.nconn = newRate, newNconn
+	r.s.Rate, r.s.Connections = newRate, newNconn
+}
@@ -0,0 +1,158 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+// Record and replay of the connection sequence. The recorder wraps the
+// source address generator and saves the source address and the start
+// time of every connection. A replay uses the same source addresses
+// and starts the connections at the same times.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// replayEntry is a connection start. "Offset" is the time since the
+// test start in nano-seconds, as in the json statistics.
+type replayEntry struct {
+	Conn      int
+	Offset    time.Duration
+	Source    string `json:",omitempty"`
+	Reconnect bool   `json:",omitempty"`
+}
+
+type replaySequence struct {
+	Connections int
+	Entries     []replayEntry
+}
+
+// replayRecorder records the connection sequence. The wrapped
+// generator may be nil if no source addresses are used.
+type replayRecorder struct {
+	gen     addressGenerator
+	started time.Time
+	nconn   int
+	mu      sync.Mutex
+	seen    map[int]bool
+	entries []replayEntry
+}
+
+func newReplayRecorder(gen addressGenerator, started time.Time, nconn int) *replayRecorder {
+	return &replayRecorder{
+		gen:     gen,
+		started: started,
+		nconn:   nconn,
+		seen:    make(map[int]bool),
+	}
+}
+
+// GetIPStringIdx is called on every connection start. The cursor is
+// the connection id.
+func (r *replayRecorder) GetIPStringIdx(cursor uint32) string {
+	var a string
+	if r.gen != nil {
+		a = r.gen.GetIPStringIdx(cursor)
+	}
+	cd := &cData[cursor]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, replayEntry{
+		Conn:      cd.conn,
+		Offset:    cd.started.Sub(r.started),
+		Source:    a,
+		Reconnect: r.seen[cd.conn],
+	})
+	r.seen[cd.conn] = true
+	return a
+}
+
+func (r *replayRecorder) save(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	file, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	seq := replaySequence{Connections: r.nconn, Entries: r.entries}
+	if err := json.NewEncoder(file).Encode(&seq); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// replayPlayer replays a recorded sequence. Connections beyond the
+// recorded sequence are started as usual and use the wrapped generator
+// (if any).
+type replayPlayer struct {
+	gen     addressGenerator
+	started time.Time
+	conns   map[int][]replayEntry
+	mu      sync.Mutex
+	next    map[int]int
+}
+
+func readReplay(path string, gen addressGenerator, started time.Time, nconn int) *replayPlayer {
+	file, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	var seq replaySequence
+	if err := json.NewDecoder(file).Decode(&seq); err != nil {
+		log.Fatal("Replay; ", err)
+	}
+	if seq.Connections != nconn {
+		log.Printf("WARNING: Replay recorded with %d connections, -nconn %d\n",
+			seq.Connections, nconn)
+	}
+	p := &replayPlayer{
+		gen:     gen,
+		started: started,
+		conns:   make(map[int][]replayEntry),
+		next:    make(map[int]int),
+	}
+	for _, e := range seq.Entries {
+		p.conns[e.Conn] = append(p.conns[e.Conn], e)
+	}
+	return p
+}
+
+// wait waits until the recorded start time of the attempt of a logical
+// connection. Returns false if the context is done. A nil player
+// returns true immediately.
+func (p *replayPlayer) wait(ctx context.Context, conn, attempt int) bool {
+	if p == nil || attempt >= len(p.conns[conn]) {
+		return true
+	}
+	t := time.NewTimer(time.Until(p.started.Add(p.conns[conn][attempt].Offset)))
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// GetIPStringIdx returns the recorded source address. Attempts of a
+// logical connection are sequential so they are counted here.
+func (p *replayPlayer) GetIPStringIdx(cursor uint32) string {
+	conn := cData[cursor].conn
+	p.mu.Lock()
+	attempt := p.next[conn]
+	p.next[conn]++
+	p.mu.Unlock()
+	if attempt < len(p.conns[conn]) && p.conns[conn][attempt].Source != "" {
+		return p.conns[conn][attempt].Source
+	}
+	if p.gen != nil {
+		return p.gen.GetIPStringIdx(cursor)
+	}
+	return ""
+}
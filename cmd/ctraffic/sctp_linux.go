@@ -0,0 +1,229 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+//go:build linux
+
+// SCTP client and server. The sctp library uses blocking sockets
+// without deadline support so the read timeout is set with SO_RCVTIMEO
+// and a blocked read is interrupted with shutdown() at test end.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"syscall"
+	"time"
+
+	"github.com/ishidawataru/sctp"
+)
+
+func sctpInitMsg(streams int, timeout time.Duration) sctp.InitMsg {
+	initTmo := timeout / time.Millisecond
+	if initTmo > 0xffff {
+		initTmo = 0xffff
+	}
+	return sctp.InitMsg{
+		NumOstreams:    uint16(streams),
+		MaxInstreams:   uint16(streams),
+		MaxInitTimeout: uint16(initTmo),
+	}
+}
+
+// sctpShutdown shuts down the socket, which interrupts blocked calls
+func sctpShutdown(conn *sctp.SCTPConn) {
+	if rc, err := conn.SyscallConn(); err == nil {
+		rc.Control(func(fd uintptr) {
+			syscall.Shutdown(int(fd), syscall.SHUT_RDWR)
+		})
+	}
+}
+
+// ----------------------------------------------------------------------
+// SCTP client
+
+type sctpConn struct {
+	cd      *connData
+	conn    *sctp.SCTPConn
+	streams int
+	ordered bool
+}
+
+func (c *config) newSctpConn(cd *connData) ctConn {
+	return &sctpConn{
+		cd:      cd,
+		streams: *c.sctpStrms,
+		ordered: *c.sctpOrder,
+	}
+}
+
+func (c *sctpConn) Connect(ctx context.Context, address string) error {
+	raddr, err := sctp.ResolveSCTPAddr("sctp", address)
+	if err != nil {
+		return err
+	}
+	var laddr *sctp.SCTPAddr
+	if c.cd.localAddr != nil {
+		if laddr, err = sctp.ResolveSCTPAddr("sctp", c.cd.localAddr.String()); err != nil {
+			return err
+		}
+	}
+	c.conn, err = sctp.DialSCTPExt(
+		"sctp", laddr, raddr, sctpInitMsg(c.streams, c.cd.connectTimeout))
+	if err != nil {
+		return err
+	}
+	// A read timeout is a lost association (as for TCP)
+	tv := syscall.NsecToTimeval(c.cd.pktTimeout.Nanoseconds())
+	rc, err := c.conn.SyscallConn()
+	if err == nil {
+		rc.Control(func(fd uintptr) {
+			err = syscall.SetsockoptTimeval(
+				int(fd), syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv)
+		})
+	}
+	if err != nil {
+		c.conn.Close()
+	}
+	return err
+}
+
+func (c *sctpConn) Run(ctx context.Context, s *statistics) error {
+	defer c.conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sctpShutdown(c.conn)
+		case <-done:
+		}
+	}()
+
+	if a := c.conn.LocalAddr(); a != nil {
+		c.cd.local = a.String()
+	}
+	if a := c.conn.RemoteAddr(); a != nil {
+		c.cd.remote = a.String()
+	}
+
+	lim := newLimiter(ctx, c.cd.rnd, c.cd.rate, c.cd.psize)
+	if lim == nil {
+		return nil
+	}
+	c.cd.setLimiter(lim)
+
+	info := &sctp.SndRcvInfo{}
+	if !c.ordered {
+		info.Flags = sctp.SCTP_UNORDERED
+	}
+	p := make([]byte, c.cd.psize)
+	for {
+		if lim.WaitN(ctx, c.cd.psize) != nil {
+			break
+		}
+
+		// Packets are sent round-robin on the streams
+		info.Stream = uint16(c.cd.sent % uint32(c.streams))
+		if _, err := c.conn.SCTPWrite(p, info); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+		c.cd.sent++
+		s.sent(1)
+
+		for lim.AllowN(time.Now(), c.cd.psize) {
+			c.cd.nPacketsDropped++
+			s.dropped(1)
+		}
+
+		n, err := c.conn.Read(p)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			return err
+		}
+
+		if c.cd.nPacketsReceived == 0 {
+			// First received packet _may_ contain a hostname
+			if i := bytes.IndexByte(p[:n], 0); i > 0 {
+				c.cd.host = string(p[:i])
+			}
+		}
+
+		c.cd.received(s, n)
+	}
+	return nil
+}
+
+// ----------------------------------------------------------------------
+// SCTP server
+
+func (c *config) sctpServerMain() int {
+	laddr, err := sctp.ResolveSCTPAddr("sctp", *c.addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := sctp.ListenSCTPExt("sctp", laddr, sctpInitMsg(*c.sctpStrms, 0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer l.Close()
+	log.Println("Listen on SCTP address; ", *c.addr)
+
+	host := serverHost()
+	for {
+		conn, err := l.AcceptSCTP()
+		if err != nil {
+			log.Fatal(err)
+		}
+		// A filler has state, e.g. the "fixed" pattern position
+		fill, err := newPayloadFiller(*c.payload)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go sctpServer(conn, host, fill)
+	}
+}
+
+// sctpServer echoes messages on the stream they were received on, or
+// responds with the same amount of -server_payload data
+func sctpServer(conn *sctp.SCTPConn, host string, fill func(p []byte)) {
+	defer conn.Close()
+	if err := conn.SubscribeEvents(sctp.SCTP_EVENT_DATA_IO); err != nil {
+		debugf("SCTP server; %v", err)
+		return
+	}
+	buf := make([]byte, 64*1024)
+	for first := true; ; first = false {
+		n, info, err := conn.SCTPRead(buf)
+		if err != nil {
+			if err != io.EOF {
+				debugf("SCTP server; %v", err)
+			}
+			return
+		}
+		if fill != nil {
+			fill(buf[:n])
+		}
+		if first {
+			if i := copy(buf[:n], host); i < n {
+				buf[i] = 0
+			}
+		}
+		if info != nil {
+			info.Flags &= sctp.SCTP_UNORDERED
+		}
+		if _, err := conn.SCTPWrite(buf[:n], info); err != nil {
+			debugf("SCTP server; %v", err)
+			return
+		}
+	}
+}
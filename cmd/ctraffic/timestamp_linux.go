@@ -0,0 +1,66 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+//go:build linux
+
+// Receive timestamps with SO_TIMESTAMPNS. The kernel stamps a packet
+// when it is received (in software, or from the NIC if hardware
+// timestamping is enabled on the interface) and the delta to the time
+// the packet is read shows the delay in the kernel and the scheduler.
+
+package main
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// timestampOob is the size of the oob buffer for a timestamp
+var timestampOob = syscall.CmsgSpace(int(unsafe.Sizeof(syscall.Timespec{})))
+
+func (c *udpConn) enableTimestamps() error {
+	rc, err := c.conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(
+			int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPNS, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return serr
+	}
+	c.oob = make([]byte, timestampOob)
+	return nil
+}
+
+// rxTimestamp returns the receive timestamp in the oob data, or a zero
+// time if there is none
+func rxTimestamp(oob []byte) time.Time {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return time.Time{}
+	}
+	for _, m := range msgs {
+		if m.Header.Level == syscall.SOL_SOCKET &&
+			m.Header.Type == syscall.SCM_TIMESTAMPNS &&
+			len(m.Data) >= int(unsafe.Sizeof(syscall.Timespec{})) {
+			ts := (*syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+			return time.Unix(ts.Unix())
+		}
+	}
+	return time.Time{}
+}
+
+// addTimestamp records the delta from the receive timestamp until now
+func (cd *connData) addTimestamp(oob []byte) {
+	if t := rxTimestamp(oob); !t.IsZero() {
+		cd.tsDeltas = append(cd.tsDeltas, int64(time.Since(t)/time.Microsecond))
+	}
+}
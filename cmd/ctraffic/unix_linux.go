@@ -0,0 +1,31 @@
+// Project page; https://github.com/Nordix/ctraffic/
+// LICENSE; MIT. See the "LICENSE" file in the Project page.
+// Copyright (C) 2024 OpenInfra Foundation Europe. All rights reserved.
+
+//go:build linux
+
+// Unix domain sockets in the Linux abstract namespace are given as
+// "unixabstract://name". The name is not a file system path, the
+// socket path is the name with a leading null byte. This is used by
+// e.g. services in containers that share a network namespace.
+
+package main
+
+import (
+	"strings"
+)
+
+const unixAbstractPrefix = "unixabstract://"
+
+func isUnixAbstract(address string) bool {
+	return strings.HasPrefix(address, unixAbstractPrefix)
+}
+
+// streamNetwork returns the network and address for net.Listen and
+// net.Dial. Addresses other than "unixabstract://name" are TCP.
+func streamNetwork(address string) (string, string) {
+	if !isUnixAbstract(address) {
+		return "tcp", address
+	}
+	return "unix", "\x00" + strings.TrimPrefix(address, unixAbstractPrefix)
+}
@@ -5,8 +5,34 @@ go 1.19
 require (
 	github.com/Nordix/mconnect/pkg/rndip/v2 v2.0.0-20240902162515-1be1c6090854
 	github.com/brucespang/go-tcpinfo v0.0.0-20161205163524-e6cc7410d081
-	golang.org/x/net v0.0.0-20210525063256-abc453219eb5
+	github.com/ishidawataru/sctp v0.0.0-20251114114122-19ddcbc6aae2
+	go.uber.org/goleak v1.2.1
+	golang.org/x/net v0.12.0
+	golang.org/x/sys v0.10.0
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	google.golang.org/grpc v1.58.3
+	google.golang.org/protobuf v1.31.0
+	modernc.org/sqlite v1.25.0
 )
 
-require golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
+	github.com/mattn/go-isatty v0.0.16 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/mod v0.8.0 // indirect
+	golang.org/x/text v0.11.0 // indirect
+	golang.org/x/tools v0.6.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230711160842-782d3b101e98 // indirect
+	lukechampine.com/uint128 v1.2.0 // indirect
+	modernc.org/cc/v3 v3.40.0 // indirect
+	modernc.org/ccgo/v3 v3.16.13 // indirect
+	modernc.org/libc v1.24.1 // indirect
+	modernc.org/mathutil v1.5.0 // indirect
+	modernc.org/memory v1.6.0 // indirect
+	modernc.org/opt v0.1.3 // indirect
+	modernc.org/strutil v1.1.3 // indirect
+	modernc.org/token v1.0.1 // indirect
+)